@@ -1,44 +1,114 @@
 package basic
 
 import (
+	"fmt"
+	"os"
+	"os/exec"
 	"path/filepath"
 
+	"golang.org/x/net/context"
+
 	autil "github.com/dropbox/changes-client/adapter"
 	"github.com/dropbox/changes-client/client"
 	"github.com/dropbox/changes-client/client/adapter"
 )
 
+// Debug config key which, if true, keeps the JobStep's workspace, like
+// --basic-keep-workspace.
+const debugKeepKey = "basicKeepWorkspace"
+
 type Adapter struct {
-	config    *client.Config
-	workspace string
+	config *client.Config
+	// The JobStep's own workspace with --basic-workspace-dir, which relative
+	// paths are relative to. If empty, they are relative to the current
+	// directory.
+	workspace      string
+	artifactSource string
 }
 
 func (a *Adapter) Init(config *client.Config) error {
-	if workspace, err := filepath.Abs(config.ArtifactSearchPath); err != nil {
+	artifactSource := config.ArtifactSearchPath
+	if workspaceDir != "" {
+		workspace, err := filepath.Abs(filepath.Join(workspaceDir, config.JobstepID))
+		if err != nil {
+			return err
+		}
+		a.workspace = workspace
+		artifactSource = a.workspacePath(artifactSource)
+	}
+	if artifactSource, err := filepath.Abs(artifactSource); err != nil {
 		return err
 	} else {
-		a.workspace = workspace
+		a.artifactSource = artifactSource
 	}
 
 	a.config = config
 	return nil
 }
 
+// workspacePath returns p with relative paths made relative to the
+// workspace, if the JobStep has one.
+func (a *Adapter) workspacePath(p string) string {
+	if a.workspace == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(a.workspace, p)
+}
+
 // Prepare the environment for future commands. This is run before any
 // commands are processed and is run once.
 func (a *Adapter) Prepare(clientLog *client.Log) (client.Metrics, error) {
-	return nil, nil
+	metrics := client.Metrics{}
+	if a.workspace == "" {
+		return metrics, nil
+	}
+	// Left behind by an earlier attempt at the same JobStep.
+	if _, err := os.Stat(a.workspace); err == nil {
+		clientLog.Printf("==> Removing existing workspace %s", a.workspace)
+		if err := os.RemoveAll(a.workspace); err != nil {
+			return metrics, err
+		}
+	}
+	timer := metrics.StartTimer()
+	if err := os.MkdirAll(filepath.Dir(a.workspace), 0755); err != nil {
+		return metrics, err
+	}
+	if workspaceTemplate == "" {
+		clientLog.Printf("==> Creating workspace %s", a.workspace)
+		if err := os.Mkdir(a.workspace, 0755); err != nil {
+			return metrics, err
+		}
+	} else {
+		clientLog.Printf("==> Creating workspace %s from %s", a.workspace, workspaceTemplate)
+		// Shutdown isn't called if Prepare fails, so a partial copy is
+		// removed here.
+		if out, err := exec.Command("cp", "-a", "--reflink=auto", filepath.Clean(workspaceTemplate), a.workspace).CombinedOutput(); err != nil {
+			os.RemoveAll(a.workspace)
+			return metrics, fmt.Errorf("Failed to copy %s: %s: %s", workspaceTemplate, err, out)
+		}
+	}
+	timer.Record("workspaceCreationTime")
+	return metrics, nil
 }
 
 // Runs a given command. This may be called multiple times depending
-func (a *Adapter) Run(cmd *client.Command, clientLog *client.Log) (*client.CommandResult, error) {
-	cw := client.NewCmdWrapper([]string{cmd.Path}, cmd.Cwd, cmd.Env)
-	return cw.Run(cmd.CaptureOutput, clientLog)
+func (a *Adapter) Run(ctx context.Context, cmd *client.Command, clientLog *client.Log) (*client.CommandResult, error) {
+	cw := client.NewCmdWrapper([]string{cmd.Path}, a.workspacePath(cmd.Cwd), cmd.Env)
+	cw.KillGracePeriod = cmd.KillGracePeriod
+	cw.Stderr = cmd.Stderr
+	return cw.RunContext(ctx, cmd.CaptureOutput, clientLog)
 }
 
 // Perform any cleanup actions within the environment.
 func (a *Adapter) Shutdown(clientLog *client.Log) (client.Metrics, error) {
-	return nil, nil
+	if a.workspace == "" {
+		return nil, nil
+	}
+	if keepWorkspace || a.config.GetDebugConfigBool(debugKeepKey, false) {
+		clientLog.Printf("[basic] Keeping workspace %s", a.workspace)
+		return nil, nil
+	}
+	return nil, os.RemoveAll(a.workspace)
 }
 
 // If applicable, capture a snapshot of the workspace for later re-use
@@ -51,11 +121,11 @@ func (a *Adapter) GetRootFs() string {
 }
 
 func (a *Adapter) CollectArtifacts(artifacts []string, clientLog *client.Log) ([]string, error) {
-	return autil.CollectArtifactsIn(a.workspace, artifacts, clientLog)
+	return autil.CollectArtifactsIn(a.artifactSource, artifacts, clientLog)
 }
 
 func (a *Adapter) GetArtifactRoot() string {
-	return a.workspace
+	return a.artifactSource
 }
 
 func New() adapter.Adapter {
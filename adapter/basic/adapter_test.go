@@ -0,0 +1,87 @@
+package basic
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/dropbox/changes-client/client"
+)
+
+func TestWorkspace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basic-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	template := filepath.Join(dir, "template")
+	require.NoError(t, os.Mkdir(template, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(template, "seed"), []byte("seed"), 0644))
+	workspaceDir, workspaceTemplate = filepath.Join(dir, "workspaces"), template
+	defer func() { workspaceDir, workspaceTemplate = "", "" }()
+
+	config, err := client.LoadConfig([]byte(`{"debugConfig": {"basicKeepWorkspace": false}}`))
+	require.NoError(t, err)
+	config.JobstepID = "js"
+	config.ArtifactSearchPath = "out"
+	log := client.NewLog()
+	defer log.Close()
+	go log.Drain()
+
+	a := &Adapter{}
+	require.NoError(t, a.Init(config))
+	workspace := filepath.Join(dir, "workspaces/js")
+	assert.Equal(t, filepath.Join(workspace, "out"), a.GetArtifactRoot())
+
+	// Left over from an earlier run.
+	require.NoError(t, os.MkdirAll(workspace, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(workspace, "stale"), nil, 0644))
+	_, err = a.Prepare(log)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(workspace, "stale"))
+	assert.True(t, os.IsNotExist(err), "Expected the workspace to be recreated")
+
+	cmd, err := client.NewCommand("test", "#!/bin/sh\ncat seed > copied\n")
+	require.NoError(t, err)
+	defer os.Remove(cmd.Path)
+	result, err := a.Run(context.Background(), cmd, log)
+	require.NoError(t, err)
+	assert.True(t, result.Success)
+	data, err := ioutil.ReadFile(filepath.Join(workspace, "copied"))
+	require.NoError(t, err)
+	assert.Equal(t, "seed", string(data))
+
+	_, err = a.Shutdown(log)
+	require.NoError(t, err)
+	_, err = os.Stat(workspace)
+	assert.True(t, os.IsNotExist(err), "Expected the workspace to be removed")
+	_, err = os.Stat(filepath.Join(template, "seed"))
+	assert.NoError(t, err)
+}
+
+func TestKeepWorkspace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basic-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	workspaceDir = dir
+	defer func() { workspaceDir = "" }()
+
+	config, err := client.LoadConfig([]byte(`{"debugConfig": {"basicKeepWorkspace": true}}`))
+	require.NoError(t, err)
+	config.JobstepID = "js"
+	log := client.NewLog()
+	defer log.Close()
+	go log.Drain()
+
+	a := &Adapter{}
+	require.NoError(t, a.Init(config))
+	_, err = a.Prepare(log)
+	require.NoError(t, err)
+	_, err = a.Shutdown(log)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "js"))
+	assert.NoError(t, err)
+}
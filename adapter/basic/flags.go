@@ -0,0 +1,17 @@
+package basic
+
+import (
+	"flag"
+)
+
+var (
+	workspaceDir      string
+	workspaceTemplate string
+	keepWorkspace     bool
+)
+
+func init() {
+	flag.StringVar(&workspaceDir, "basic-workspace-dir", "", "If set, the basic adapter runs each JobStep in a fresh workspace in this directory rather than in the current directory")
+	flag.StringVar(&workspaceTemplate, "basic-workspace-template", "", "Directory whose contents are copied (or reflinked, where supported) into each --basic-workspace-dir workspace")
+	flag.BoolVar(&keepWorkspace, "basic-keep-workspace", false, "Do not remove the basic adapter's --basic-workspace-dir workspace on cleanup")
+}
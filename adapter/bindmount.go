@@ -0,0 +1,42 @@
+package adapter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BindMount is a host directory to be mounted within a container, given on
+// the command line as <source>:<dest>:<options>.
+type BindMount struct {
+	Source  string // include trailing slash
+	Dest    string // no trailing slash
+	Options string // comma separated, fstab style
+}
+
+func ParseBindMount(str string) (*BindMount, error) {
+	split := strings.SplitN(str, ":", 3)
+	if len(split) != 3 {
+		return nil, fmt.Errorf("Invalid bind mount: %s", str)
+	}
+	return &BindMount{
+		Source:  split[0],
+		Dest:    split[1],
+		Options: split[2],
+	}, nil
+}
+
+// ParseBindMounts parses a comma separated list of bind mounts.
+func ParseBindMounts(str string) ([]*BindMount, error) {
+	var mounts []*BindMount
+	if str == "" {
+		return mounts, nil
+	}
+	for _, ms := range strings.Split(str, ",") {
+		mount, err := ParseBindMount(ms)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
@@ -11,6 +11,8 @@ import (
 	"strings"
 	"time"
 
+	"golang.org/x/net/context"
+
 	autil "github.com/dropbox/changes-client/adapter"
 	"github.com/dropbox/changes-client/client"
 	"github.com/dropbox/changes-client/client/adapter"
@@ -59,30 +61,15 @@ func (a *Adapter) Init(config *client.Config) error {
 		return err
 	}
 	// Dest must be a relative path
-	inputMount := &BindMount{Source: inputMountSource, Dest: strings.TrimLeft(containerInputDirectory, "/"), Options: "ro,create=dir"}
-	mounts := []*BindMount{inputMount}
-	if bindMounts != "" {
-		mountStrings := strings.Split(bindMounts, ",")
-		for _, ms := range mountStrings {
-			if mount, err := ParseBindMount(ms); err != nil {
-				return err
-			} else {
-				mounts = append(mounts, mount)
-			}
-		}
-	}
-
-	mergeLimits := func(v int, other *int) int {
-		if other != nil {
-			if v == 0 || *other < v {
-				return *other
-			}
-		}
-		return v
+	inputMount := &autil.BindMount{Source: inputMountSource, Dest: strings.TrimLeft(containerInputDirectory, "/"), Options: "ro,create=dir"}
+	extraMounts, err := autil.ParseBindMounts(bindMounts)
+	if err != nil {
+		return err
 	}
+	mounts := append([]*autil.BindMount{inputMount}, extraMounts...)
 
-	cpuLimit := mergeLimits(cpus, config.ResourceLimits.Cpus)
-	memoryLimit := mergeLimits(memory, config.ResourceLimits.Memory)
+	cpuLimit := autil.MergeLimits(cpus, config.ResourceLimits.Cpus)
+	memoryLimit := autil.MergeLimits(memory, config.ResourceLimits.Memory)
 
 	container := &Container{
 		Name:           config.JobstepID,
@@ -152,8 +139,8 @@ func (a *Adapter) Prepare(clientLog *client.Log) (client.Metrics, error) {
 }
 
 // Runs a given command. This may be called multiple times depending
-func (a *Adapter) Run(cmd *client.Command, clientLog *client.Log) (*client.CommandResult, error) {
-	return a.container.RunCommandInContainer(cmd, clientLog, "ubuntu")
+func (a *Adapter) Run(ctx context.Context, cmd *client.Command, clientLog *client.Log) (*client.CommandResult, error) {
+	return a.container.RunCommandInContainer(ctx, cmd, clientLog, "ubuntu")
 }
 
 // Perform any cleanup actions within the environment.
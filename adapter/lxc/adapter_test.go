@@ -10,6 +10,8 @@ import (
 	"testing"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/dropbox/changes-client/client"
 	"github.com/dropbox/changes-client/client/adapter"
 	"github.com/hashicorp/go-version"
@@ -103,7 +105,7 @@ func TestCompleteFlow(t *testing.T) {
 	require.NoError(t, err)
 
 	var result *client.CommandResult
-	result, err = adapter.Run(cmd, clientLog)
+	result, err = adapter.Run(context.Background(), cmd, clientLog)
 	require.NoError(t, err)
 	require.Equal(t, "", string(result.Output))
 	require.True(t, result.Success)
@@ -112,7 +114,7 @@ func TestCompleteFlow(t *testing.T) {
 	cmd.CaptureOutput = true
 	require.NoError(t, err)
 
-	result, err = adapter.Run(cmd, clientLog)
+	result, err = adapter.Run(context.Background(), cmd, clientLog)
 	require.NoError(t, err)
 	require.Equal(t, "/home/ubuntu\n", string(result.Output))
 	require.True(t, result.Success)
@@ -121,7 +123,7 @@ func TestCompleteFlow(t *testing.T) {
 	cmd.CaptureOutput = true
 	require.NoError(t, err)
 
-	result, err = adapter.Run(cmd, clientLog)
+	result, err = adapter.Run(context.Background(), cmd, clientLog)
 	require.NoError(t, err)
 	require.True(t, result.Success)
 
@@ -129,7 +131,7 @@ func TestCompleteFlow(t *testing.T) {
 	cmd, err = client.NewCommand("test", "#!/bin/bash -e\nread foo\nexit 1")
 	require.NoError(t, err)
 
-	result, err = adapter.Run(cmd, clientLog)
+	result, err = adapter.Run(context.Background(), cmd, clientLog)
 	require.NoError(t, err)
 	require.Equal(t, "", string(result.Output))
 	require.False(t, result.Success)
@@ -144,7 +146,7 @@ func TestCompleteFlow(t *testing.T) {
 	cmd, err = client.NewCommand("test", "/var/changes/input/blacklist-remove nonexistent.yaml")
 	require.NoError(t, err)
 
-	result, err = adapter.Run(cmd, clientLog)
+	result, err = adapter.Run(context.Background(), cmd, clientLog)
 	require.NoError(t, err)
 	// running blacklist-remove with a nonexistent yaml file should print
 	// a message and succeed
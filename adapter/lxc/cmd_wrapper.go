@@ -6,22 +6,38 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/dropbox/changes-client/client"
 	"gopkg.in/lxc/go-lxc.v2"
 )
 
+// Every process started by an LxcCommand inherits this environment variable
+// with a value unique to the command. Processes in the container are visible
+// from the host, so this lets us find and kill the command's entire process
+// tree without having to track pids across the PID namespace.
+const commandMarkerEnv = "CHANGES_CLIENT_COMMAND"
+
 type LxcCommand struct {
 	Args []string
 	User string
 	Env  []string
 	Cwd  string
+	// How long to wait after SIGTERM before sending SIGKILL when Run's
+	// context is done. If zero, SIGKILL is sent right away.
+	KillGracePeriod time.Duration
+	// If set, stderr is also written to this log.
+	Stderr *client.Log
 }
 
 func NewLxcCommand(args []string, user string) *LxcCommand {
@@ -47,7 +63,39 @@ func timedWait(fn func(), timeout time.Duration) error {
 	}
 }
 
-func (cw *LxcCommand) Run(captureOutput bool, clientLog *client.Log, container *lxc.Container) (*client.CommandResult, error) {
+// killMarkedProcesses sends sig to every process whose environment contains
+// commandMarkerEnv set to marker, and returns the number of processes signalled.
+func killMarkedProcesses(marker string, sig syscall.Signal) int {
+	procDirs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		log.Printf("[lxc] Failed to list processes: %s", err)
+		return 0
+	}
+	needle := []byte(commandMarkerEnv + "=" + marker)
+	count := 0
+	for _, dir := range procDirs {
+		// Fails for processes that have exited since the Glob, which is fine.
+		environ, err := ioutil.ReadFile(filepath.Join(dir, "environ"))
+		if err != nil {
+			continue
+		}
+		for _, kv := range bytes.Split(environ, []byte{0}) {
+			if !bytes.Equal(kv, needle) {
+				continue
+			}
+			if pid, err := strconv.Atoi(filepath.Base(dir)); err == nil && syscall.Kill(pid, sig) == nil {
+				count++
+			}
+			break
+		}
+	}
+	return count
+}
+
+// Run executes the command in the container. If ctx is done before the
+// command exits, every process the command started is sent SIGTERM, and
+// then SIGKILL once the command exits or KillGracePeriod has passed.
+func (cw *LxcCommand) Run(ctx context.Context, captureOutput bool, clientLog *client.Log, container *lxc.Container) (*client.CommandResult, error) {
 	clientLog.Printf("==> Executing %s", strings.Join(cw.Args, " "))
 
 	inreader, inwriter, err := os.Pipe()
@@ -70,6 +118,32 @@ func (cw *LxcCommand) Run(captureOutput bool, clientLog *client.Log, container *
 	}
 
 	cmdwriterFd := cmdwriter.Fd()
+	errwriterFd := cmdwriterFd
+
+	// To keep stderr separate, it gets its own pipe, which we copy to both the
+	// combined output and the stderr log.
+	var errwriter *os.File
+	var errlogwriter *io.PipeWriter
+	stderrLogged := make(chan struct{})
+	if cw.Stderr != nil {
+		var errreader *os.File
+		errreader, errwriter, err = os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		errwriterFd = errwriter.Fd()
+		var errlogreader *io.PipeReader
+		errlogreader, errlogwriter = io.Pipe()
+		go func() {
+			io.Copy(io.MultiWriter(cmdwriter, errlogwriter), errreader)
+			errreader.Close()
+			errlogwriter.Close()
+		}()
+		go func() {
+			cw.Stderr.WriteStream(errlogreader)
+			close(stderrLogged)
+		}()
+	}
 
 	inreader.Close()
 	inwriter.Close()
@@ -95,6 +169,8 @@ func (cw *LxcCommand) Run(captureOutput bool, clientLog *client.Log, container *
 	for i := 0; i < len(cw.Env); i++ {
 		env = append(env, cw.Env[i])
 	}
+	marker := randString(16)
+	env = append(env, commandMarkerEnv+"="+marker)
 
 	var clientLogClosed sync.WaitGroup
 	clientLogClosed.Add(1)
@@ -103,11 +179,36 @@ func (cw *LxcCommand) Run(captureOutput bool, clientLog *client.Log, container *
 		clientLog.WriteStream(reader)
 	}()
 
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			if cw.KillGracePeriod > 0 {
+				clientLog.Printf("==> Sending SIGTERM; killing in %s if still running", cw.KillGracePeriod)
+				killMarkedProcesses(marker, syscall.SIGTERM)
+				select {
+				case <-time.After(cw.KillGracePeriod):
+				case <-exited:
+				}
+			}
+			// Processes may fork while we're looking for them, so repeat
+			// until nothing is left (with a bound, to be safe).
+			for i := 0; i < 10 && killMarkedProcesses(marker, syscall.SIGKILL) > 0; i++ {
+				time.Sleep(100 * time.Millisecond)
+			}
+		case <-exited:
+		}
+	}()
+
+	// The container's CPU time is the closest we can get to the command's; it's
+	// only accurate if the command is the only thing running in the container.
+	cpuTimeBefore, cpuErr := container.CPUTime()
+	start := time.Now()
 	log.Printf("[lxc] Executing %s from [%s]", cmdAsUser, cwd)
 	exitCode, err := container.RunCommandStatus(cmdAsUser, lxc.AttachOptions{
 		StdinFd:    inwriter.Fd(),
 		StdoutFd:   cmdwriterFd,
-		StderrFd:   cmdwriterFd,
+		StderrFd:   errwriterFd,
 		Env:        env,
 		Cwd:        cwd,
 		Arch:       lxc.X86_64,
@@ -116,6 +217,17 @@ func (cw *LxcCommand) Run(captureOutput bool, clientLog *client.Log, container *
 		GID:        -1,
 		ClearEnv:   true,
 	})
+	wallTime := time.Since(start)
+	close(exited)
+	if errwriter != nil {
+		// As with cmdwriter below, duplicates of errwriter may keep the
+		// stream open, so don't wait forever for the copy to finish.
+		errwriter.Close()
+		if timedWait(func() { <-stderrLogged }, 10*time.Second) != nil {
+			clientLog.Printf("Timed out waiting for stderr to close")
+			errlogwriter.Close()
+		}
+	}
 	if err != nil {
 		clientLog.Printf("Running the command failed: %s", err)
 		cmdwriter.Close()
@@ -145,14 +257,27 @@ func (cw *LxcCommand) Run(captureOutput bool, clientLog *client.Log, container *
 		clientLog.Printf("Timed out waiting for waitGroup to complete")
 	}
 
-	clientLog.Printf("Command exited with status %d", exitCode)
-
+	// RunCommandStatus returns the raw status from waitpid().
+	status := syscall.WaitStatus(exitCode)
 	result := &client.CommandResult{
-		Success: exitCode == 0,
+		Success:  exitCode == 0,
+		ExitCode: status.ExitStatus(),
+		WallTime: wallTime,
+	}
+	if status.Signaled() {
+		result.Signal = status.Signal()
+		clientLog.Printf("Command was killed by signal %s", result.Signal)
+	} else {
+		clientLog.Printf("Command exited with status %d", status.ExitStatus())
+	}
+	if cpuErr == nil {
+		if cpuTimeAfter, err := container.CPUTime(); err == nil {
+			result.CPUTime = cpuTimeAfter - cpuTimeBefore
+		}
 	}
 
 	if captureOutput {
-		result.Output = buffer.Bytes()
+		result.Output = client.Redact(buffer.Bytes())
 	} else {
 		result.Output = []byte("")
 	}
@@ -16,6 +16,9 @@ import (
 	"strings"
 	"time"
 
+	"golang.org/x/net/context"
+
+	autil "github.com/dropbox/changes-client/adapter"
 	"github.com/dropbox/changes-client/client"
 	"github.com/dropbox/changes-client/common/lockfile"
 	"github.com/dropbox/changes-client/common/taggederr"
@@ -56,7 +59,7 @@ type Container struct {
 	OutputSnapshot string
 	MemoryLimit    int
 	CpuLimit       int
-	BindMounts     []*BindMount
+	BindMounts     []*autil.BindMount
 	// directory we should copy files into to make them accessible to the container.
 	InputMountSource string
 	// Valid values: xz, lz4. These are also used as the file extensions
@@ -70,25 +73,8 @@ type Container struct {
 	Executor      *Executor
 }
 
-type BindMount struct {
-	Source  string // include trailing slash
-	Dest    string // no trailing slash
-	Options string // comma separated, fstab style
-}
-
-func ParseBindMount(str string) (*BindMount, error) {
-	split := strings.SplitN(str, ":", 3)
-	if len(split) != 3 {
-		return nil, fmt.Errorf("Invalid bind mount: %s", str)
-	}
-	return &BindMount{
-		Source:  split[0],
-		Dest:    split[1],
-		Options: split[2],
-	}, nil
-}
-
-func (b *BindMount) Format() string {
+// mountEntry formats b as an lxc.mount.entry value.
+func mountEntry(b *autil.BindMount) string {
 	return fmt.Sprintf("%s %s none bind,%s", b.Source, b.Dest, b.Options)
 }
 
@@ -444,7 +430,7 @@ func (c *Container) getConfigSetters() []configSetter {
 	}
 
 	for _, mount := range c.BindMounts {
-		result = append(result, configItem{"lxc.mount.entry", mount.Format()})
+		result = append(result, configItem{"lxc.mount.entry", mountEntry(mount)})
 	}
 
 	return result
@@ -691,7 +677,7 @@ func randString(n int) string {
 // Runs a command in a container. This "uploads" the command to the container,
 // essentially copying the command from the host to the container filesystem,
 // and then runs the new temporary file, capturing output.
-func (c *Container) RunCommandInContainer(cmd *client.Command, clientLog *client.Log, user string) (*client.CommandResult, error) {
+func (c *Container) RunCommandInContainer(ctx context.Context, cmd *client.Command, clientLog *client.Log, user string) (*client.CommandResult, error) {
 	dstFilename := fmt.Sprintf("script-%s", randString(10))
 
 	log.Printf("[lxc] Writing local script %s to %s", cmd.Path, dstFilename)
@@ -708,8 +694,11 @@ func (c *Container) RunCommandInContainer(cmd *client.Command, clientLog *client
 		User: user,
 		Cwd:  cmd.Cwd,
 		Env:  cmd.Env,
+
+		KillGracePeriod: cmd.KillGracePeriod,
+		Stderr:          cmd.Stderr,
 	}
-	return cw.Run(cmd.CaptureOutput, clientLog, c.lxc)
+	return cw.Run(ctx, cmd.CaptureOutput, clientLog, c.lxc)
 }
 
 // Gets the image path associated with a specific snapshot.
@@ -965,7 +954,7 @@ func (c *Container) runPostLaunch(clientLog *client.Log) error {
 		User: "root",
 		Env:  env,
 	}
-	result, err := cw.Run(false, clientLog, c.lxc)
+	result, err := cw.Run(context.Background(), false, clientLog, c.lxc)
 	if err != nil {
 		return err
 	}
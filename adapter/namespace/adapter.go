@@ -0,0 +1,209 @@
+// +build linux
+
+package namespaceadapter
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/context"
+
+	autil "github.com/dropbox/changes-client/adapter"
+	"github.com/dropbox/changes-client/client"
+	"github.com/dropbox/changes-client/client/adapter"
+)
+
+// Adapter runs each command in new user, mount, PID, UTS, IPC and (unless
+// the network is shared) network namespaces, chrooted into an overlay of the
+// root filesystem. Commands see each other's changes, but the root
+// filesystem itself is never modified.
+//
+// Commands run as root within the sandbox, which is the user changes-client
+// runs as outside it. Mounting the overlay usually requires running as root.
+type Adapter struct {
+	config *client.Config
+	// Holds the overlay's upper, work and mount point directories.
+	dir string
+	// Lower directories of the overlay, topmost first.
+	layers         []string
+	mounted        bool
+	artifactSource string
+}
+
+func (a *Adapter) Init(config *client.Config) error {
+	if rootfs == "" {
+		return errors.New("The namespace adapter requires --sandbox-rootfs")
+	}
+	a.layers = []string{rootfs}
+	if config.Snapshot.ID != "" {
+		snapshot := filepath.Join(snapshotDir, adapter.FormatUUID(config.Snapshot.ID))
+		if _, err := os.Stat(snapshot); err != nil {
+			log.Printf("[namespace] WARNING: snapshot %s not found, ignored", snapshot)
+		} else {
+			a.layers = append([]string{snapshot}, a.layers...)
+		}
+	}
+	a.dir = filepath.Join(sandboxDir, config.JobstepID)
+	a.config = config
+	return nil
+}
+
+// Prepare mounts the overlay that commands are run in.
+func (a *Adapter) Prepare(clientLog *client.Log) (client.Metrics, error) {
+	metrics := client.Metrics{}
+	defer metrics.StartTimer().Record("sandboxPrepareTime")
+
+	upper, work := filepath.Join(a.dir, "upper"), filepath.Join(a.dir, "work")
+	for _, d := range []string{upper, work, a.GetRootFs()} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return metrics, err
+		}
+	}
+	clientLog.Printf("==> Mounting overlay of %s at %s", strings.Join(a.layers, ", "), a.GetRootFs())
+	if err := syscall.Mount("overlay", a.GetRootFs(), "overlay", 0, autil.OverlayOptions(a.layers, upper, work)); err != nil {
+		return metrics, fmt.Errorf("Failed to mount overlay (the namespace adapter usually needs to run as root): %s", err)
+	}
+	a.mounted = true
+
+	if err := os.MkdirAll(a.hostPath(workspace), 0755); err != nil {
+		return metrics, err
+	}
+	// Commands need somewhere to put their scripts and temporary files.
+	if err := os.MkdirAll(a.hostPath("/tmp"), 0777); err != nil {
+		return metrics, err
+	}
+	if err := os.Chmod(a.hostPath("/tmp"), 01777); err != nil {
+		return metrics, err
+	}
+	a.artifactSource = a.hostPath(sandboxPath(a.config.ArtifactSearchPath))
+	return metrics, nil
+}
+
+// sandboxPath returns the path within the sandbox that p refers to, with
+// relative paths being relative to the workspace.
+func sandboxPath(p string) string {
+	if filepath.IsAbs(p) {
+		return filepath.Clean(p)
+	}
+	return filepath.Join(workspace, p)
+}
+
+// hostPath returns the path outside the sandbox of a path within it.
+func (a *Adapter) hostPath(p string) string {
+	return filepath.Join(a.GetRootFs(), p)
+}
+
+// Run copies the command's script into the sandbox and runs it there by
+// running changes-client again in new namespaces, as the sandbox's init
+// process. The init chroots into the overlay, runs the script as root from
+// its working directory (relative to --sandbox-workspace), and passes on
+// the signals sent when the command is cancelled.
+func (a *Adapter) Run(ctx context.Context, cmd *client.Command, clientLog *client.Log) (*client.CommandResult, error) {
+	// The script is outside the sandbox, so it has to be copied in.
+	script := filepath.Join("/tmp", "changes-client-"+filepath.Base(cmd.Path))
+	if err := autil.CopyFile(cmd.Path, a.hostPath(script), 0755); err != nil {
+		return nil, err
+	}
+	defer os.Remove(a.hostPath(script))
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	env := append([]string{initEnv + "=1"}, cmd.Env...)
+	cw := client.NewCmdWrapper([]string{self, a.GetRootFs(), sandboxPath(cmd.Cwd), script}, "", env)
+	cw.Isolate(cloneflags(), idMappings(os.Getuid()), idMappings(os.Getgid()))
+	cw.KillGracePeriod = cmd.KillGracePeriod
+	cw.Stderr = cmd.Stderr
+	clientLog.Printf("==> Running %s in sandbox %s", script, a.GetRootFs())
+	return cw.RunContext(ctx, cmd.CaptureOutput, clientLog)
+}
+
+// cloneflags returns the namespaces to run commands in.
+func cloneflags() uintptr {
+	flags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+		syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC
+	if !shareNetwork {
+		flags |= syscall.CLONE_NEWNET
+	}
+	return uintptr(flags)
+}
+
+// idMappings maps root in the sandbox to the given user or group outside it.
+func idMappings(hostID int) []syscall.SysProcIDMap {
+	return []syscall.SysProcIDMap{{ContainerID: 0, HostID: hostID, Size: 1}}
+}
+
+// Perform any cleanup actions within the environment.
+func (a *Adapter) Shutdown(clientLog *client.Log) (client.Metrics, error) {
+	if a.mounted {
+		if err := syscall.Unmount(a.GetRootFs(), 0); err != nil {
+			clientLog.Printf("[namespace] Failed to unmount %s, detaching it instead: %s", a.GetRootFs(), err)
+			if err := syscall.Unmount(a.GetRootFs(), syscall.MNT_DETACH); err != nil {
+				return nil, err
+			}
+		}
+		a.mounted = false
+	}
+	if keepSandbox {
+		clientLog.Printf("[namespace] Keeping sandbox %s", a.dir)
+		return nil, nil
+	}
+	return nil, os.RemoveAll(a.dir)
+}
+
+// CaptureSnapshot saves the changes commands made to the root filesystem,
+// on top of those in the snapshot the sandbox started from, if any, so they
+// can be used as a layer of future sandboxes.
+func (a *Adapter) CaptureSnapshot(outputSnapshot string, clientLog *client.Log) error {
+	dest := filepath.Join(snapshotDir, adapter.FormatUUID(outputSnapshot))
+	clientLog.Printf("==> Saving snapshot to %s", dest)
+	tmp := dest + ".partial"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	sources := []string{filepath.Join(a.dir, "upper")}
+	if len(a.layers) > 1 {
+		// Started from a snapshot, which the changes are relative to.
+		sources = []string{a.layers[0], sources[0]}
+	}
+	for _, src := range sources {
+		// Preserves the overlay's whiteouts and opaque directories, so the
+		// snapshot can itself be a lower layer.
+		if out, err := exec.Command("cp", "-a", "--remove-destination", src+"/.", tmp).CombinedOutput(); err != nil {
+			os.RemoveAll(tmp)
+			return fmt.Errorf("Failed to copy %s to snapshot: %s: %s", src, err, out)
+		}
+	}
+	return os.Rename(tmp, dest)
+}
+
+func (a *Adapter) GetRootFs() string {
+	return filepath.Join(a.dir, "root")
+}
+
+func (a *Adapter) CollectArtifacts(artifacts []string, clientLog *client.Log) ([]string, error) {
+	log.Printf("[namespace] Searching for %s in %s", artifacts, a.artifactSource)
+	return autil.CollectArtifactsIn(a.artifactSource, artifacts, clientLog)
+}
+
+func (a *Adapter) GetArtifactRoot() string {
+	return a.artifactSource
+}
+
+func New() adapter.Adapter {
+	return &Adapter{}
+}
+
+func init() {
+	adapter.Register("namespace", New)
+}
@@ -0,0 +1,83 @@
+// +build linux
+
+package namespaceadapter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/dropbox/changes-client/client"
+)
+
+func TestSandboxPath(t *testing.T) {
+	workspace = "/workspace"
+	assert.Equal(t, "/workspace", sandboxPath(""))
+	assert.Equal(t, "/workspace/src", sandboxPath("src"))
+	assert.Equal(t, "/tmp", sandboxPath("/tmp/"))
+}
+
+func TestRunInSandbox(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("The namespace adapter needs to run as root")
+	}
+	dir, err := ioutil.TempDir("", "namespace-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(r, d, w string) { rootfs, sandboxDir, workspace = r, d, w }(rootfs, sandboxDir, workspace)
+	// The host's own root filesystem, which the overlay keeps unmodified.
+	rootfs, sandboxDir, workspace = "/", dir, "/workspace"
+
+	a := &Adapter{}
+	require.NoError(t, a.Init(&client.Config{JobstepID: "js"}))
+	log := client.NewLog()
+	defer log.Close()
+	go log.Drain()
+	_, err = a.Prepare(log)
+	require.NoError(t, err)
+	defer a.Shutdown(log)
+
+	run := func(ctx context.Context, script string) *client.CommandResult {
+		cmd, err := client.NewCommand("test", "#!/bin/sh\n"+script)
+		require.NoError(t, err)
+		defer os.Remove(cmd.Path)
+		cmd.CaptureOutput = true
+		cmd.KillGracePeriod = 10 * time.Second
+		result, err := a.Run(ctx, cmd, log)
+		require.NoError(t, err)
+		return result
+	}
+
+	// Runs as root, but not as the namespace's init.
+	result := run(context.Background(), "[ $$ != 1 ] && echo $(id -u) $(pwd) $(cat /proc/self/setgroups)\necho data > out\nexit 3\n")
+	assert.Equal(t, 3, result.ExitCode)
+	assert.Equal(t, "0 /workspace allow\n", string(result.Output))
+	data, err := ioutil.ReadFile(filepath.Join(a.GetRootFs(), "workspace/out"))
+	require.NoError(t, err)
+	assert.Equal(t, "data\n", string(data))
+	_, err = os.Stat("/workspace/out")
+	assert.True(t, os.IsNotExist(err), "Expected the host's root filesystem to be unmodified")
+
+	// The command gets a chance to exit cleanly when cancelled.
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result = run(ctx, "trap 'echo terminated; exit 4' TERM\nsleep 30 &\nwait\n")
+	assert.True(t, time.Since(start) < 5*time.Second, "Took %s to stop", time.Since(start))
+	assert.Equal(t, 4, result.ExitCode)
+	assert.Equal(t, "terminated\n", string(result.Output))
+
+	// Even if it doesn't handle SIGTERM.
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	result = run(ctx, "sleep 30\necho survived\n")
+	assert.Equal(t, 128+int(syscall.SIGTERM), result.ExitCode)
+	assert.Equal(t, "", string(result.Output))
+}
@@ -0,0 +1,6 @@
+// +build !linux
+
+package namespaceadapter
+
+// This file is in place to make sure the 'namespace' package can be built on non-Linux
+// machines. Namespaces are only supported on Linux.
@@ -0,0 +1,24 @@
+package namespaceadapter
+
+import (
+	"flag"
+)
+
+// Flags are stored here so they are available even for non-Linux builds.
+var (
+	rootfs       string
+	sandboxDir   string
+	snapshotDir  string
+	workspace    string
+	shareNetwork bool
+	keepSandbox  bool
+)
+
+func init() {
+	flag.StringVar(&rootfs, "sandbox-rootfs", "", "Root filesystem directory for the namespace adapter, which is never modified")
+	flag.StringVar(&sandboxDir, "sandbox-dir", "/var/lib/changes-client/sandboxes", "Directory for the namespace adapter's per-JobStep overlays")
+	flag.StringVar(&snapshotDir, "sandbox-snapshot-dir", "/var/lib/changes-client/snapshots", "Directory for the namespace adapter's snapshots")
+	flag.StringVar(&workspace, "sandbox-workspace", "/workspace", "Directory within the sandbox that relative paths are relative to")
+	flag.BoolVar(&shareNetwork, "sandbox-share-network", false, "Let sandboxed commands use the host's network rather than only loopback")
+	flag.BoolVar(&keepSandbox, "keep-sandbox", false, "Do not remove the namespace adapter's overlay on cleanup")
+}
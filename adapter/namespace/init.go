@@ -0,0 +1,179 @@
+// +build linux
+
+package namespaceadapter
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Commands are run by running this binary again in the sandbox's namespaces,
+// with this set in its environment, to finish setting up the sandbox from
+// the inside before running the command itself.
+const initEnv = "_CHANGES_CLIENT_SANDBOX_INIT"
+
+// Exit status if the sandbox couldn't be set up.
+const initFailedExitCode = 127
+
+// Devices bound into the sandbox's /dev from the host's.
+var sandboxDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+func init() {
+	if os.Getenv(initEnv) == "" {
+		return
+	}
+	// Only returns if the command couldn't be run.
+	err := sandboxInit(os.Args[1:])
+	fmt.Fprintf(os.Stderr, "Failed to set up sandbox: %s\n", err)
+	os.Exit(initFailedExitCode)
+}
+
+// Signals passed on to the command. SIGKILL needs no help: it kills us, and
+// with us every process in the sandbox.
+var forwardedSignals = []os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP,
+	syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2}
+
+// sandboxInit chroots into root, mounts /proc and /dev, and runs script from
+// cwd. It is run as root in the sandbox's new namespaces, and stays on as
+// their init process until the script exits.
+func sandboxInit(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("expected a root, working directory and script, not %q", args)
+	}
+	root, cwd, script := args[0], args[1], args[2]
+
+	// Keep what we mount from leaking out of the sandbox.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %s", err)
+	}
+	if err := mountDev(filepath.Join(root, "dev")); err != nil {
+		return fmt.Errorf("mounting /dev: %s", err)
+	}
+	if err := syscall.Chroot(root); err != nil {
+		return fmt.Errorf("chroot to %s: %s", root, err)
+	}
+	if err := os.MkdirAll("/proc", 0555); err != nil {
+		return err
+	}
+	// We're the first process in a new PID namespace, so this shows only the
+	// sandbox's processes.
+	if err := syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mounting /proc: %s", err)
+	}
+	// Fails harmlessly if the network is shared.
+	loopbackUp()
+	if err := os.Chdir(cwd); err != nil {
+		return err
+	}
+
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, initEnv+"=") {
+			env = append(env, e)
+		}
+	}
+	// As PID 1 of the namespace we'd ignore any signal we don't handle, so
+	// rather than exec the script we forward signals to it, and reap the
+	// orphans it leaves behind.
+	signals := make(chan os.Signal, len(forwardedSignals))
+	signal.Notify(signals, forwardedSignals...)
+	pid, err := syscall.ForkExec(script, []string{script}, &syscall.ProcAttr{
+		Env:   env,
+		Files: []uintptr{0, 1, 2},
+		// In its own process group, so that signals sent to the group
+		// we're in reach it only once, through us.
+		Sys: &syscall.SysProcAttr{Setpgid: true},
+	})
+	if err != nil {
+		return err
+	}
+	go func() {
+		for sig := range signals {
+			syscall.Kill(-pid, sig.(syscall.Signal))
+		}
+	}()
+	os.Exit(reap(pid))
+	return nil
+}
+
+// reap waits for processes in the sandbox until the one with the given pid
+// exits, and returns the status to exit with, which is 128 plus the signal
+// number if it was killed by a signal.
+func reap(pid int) int {
+	for {
+		var status syscall.WaitStatus
+		wpid, err := syscall.Wait4(-1, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to wait for command: %s\n", err)
+			return initFailedExitCode
+		}
+		if wpid != pid {
+			continue
+		}
+		if status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return status.ExitStatus()
+	}
+}
+
+// mountDev mounts a minimal /dev at dev, with only the usual harmless devices.
+func mountDev(dev string) error {
+	if err := os.MkdirAll(dev, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=755"); err != nil {
+		return err
+	}
+	for _, name := range sandboxDevices {
+		target := filepath.Join(dev, name)
+		f, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		if err := syscall.Mount(filepath.Join("/dev", name), target, "", syscall.MS_BIND, ""); err != nil {
+			return err
+		}
+	}
+	for name, target := range map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	} {
+		if err := os.Symlink(target, filepath.Join(dev, name)); err != nil {
+			return err
+		}
+	}
+	for _, d := range []string{"pts", "shm"} {
+		if err := os.Mkdir(filepath.Join(dev, d), 0755); err != nil {
+			return err
+		}
+	}
+	return syscall.Mount("shm", filepath.Join(dev, "shm"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777")
+}
+
+// loopbackUp brings up the loopback interface of a new network namespace.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	// struct ifreq: the interface name, followed by its flags.
+	var ifr [40]byte
+	copy(ifr[:syscall.IFNAMSIZ], "lo")
+	*(*uint16)(unsafe.Pointer(&ifr[syscall.IFNAMSIZ])) = syscall.IFF_UP | syscall.IFF_RUNNING
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr[0]))); errno != 0 {
+		return errno
+	}
+	return nil
+}
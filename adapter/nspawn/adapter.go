@@ -0,0 +1,300 @@
+// +build linux
+
+package nspawnadapter
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/net/context"
+
+	autil "github.com/dropbox/changes-client/adapter"
+	"github.com/dropbox/changes-client/client"
+	"github.com/dropbox/changes-client/client/adapter"
+)
+
+// The directory in which the container can access files that are copied into
+// the adapter's inputDir, as with the LXC adapter.
+const containerInputDirectory = "/var/changes/input"
+
+// These binaries are made available in the container at
+// containerInputDirectory if they are found on the host.
+var mountedBinaries = [...]string{"blacklist-remove"}
+
+// Adapter runs each command with systemd-nspawn in an overlay of a snapshot
+// image (or of --nspawn-base-image), so that commands see each other's
+// changes but the image itself is never modified. It is meant to run the
+// same build plans as the LXC adapter on hosts without LXC.
+type Adapter struct {
+	config *client.Config
+	// Used to name the machine each command is run in.
+	name     string
+	snapshot string
+	// Holds the overlay's upper, work and mount point directories.
+	dir string
+	// Host directory mounted at containerInputDirectory.
+	inputDir       string
+	mounts         []*autil.BindMount
+	cpuLimit       int
+	memoryLimit    int
+	mounted        bool
+	artifactSource string
+	runs           int32
+	// Holds a value while a command runs. systemd-nspawn locks the
+	// directory it runs a machine in until the machine exits, so commands
+	// in a parallel group have to take turns.
+	running chan struct{}
+}
+
+func (a *Adapter) Init(config *client.Config) error {
+	if config.Snapshot.ID != "" {
+		a.snapshot = adapter.FormatUUID(config.Snapshot.ID)
+	} else if baseImage == "" {
+		return errors.New("The nspawn adapter requires --nspawn-base-image for JobSteps without a snapshot")
+	}
+	if compression != "xz" && compression != "lz4" {
+		log.Printf("[nspawn] Warning: invalid compression %s, defaulting to lzma", compression)
+		compression = "xz"
+	}
+
+	inputDir, err := ioutil.TempDir("", "changes-client-input-")
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(inputDir, 0755); err != nil {
+		return err
+	}
+	extraMounts, err := autil.ParseBindMounts(bindMounts)
+	if err != nil {
+		return err
+	}
+	inputMount := &autil.BindMount{Source: inputDir, Dest: containerInputDirectory, Options: "ro"}
+	a.mounts = append([]*autil.BindMount{inputMount}, extraMounts...)
+	a.inputDir = inputDir
+
+	a.cpuLimit = autil.MergeLimits(cpus, config.ResourceLimits.Cpus)
+	a.memoryLimit = autil.MergeLimits(memory, config.ResourceLimits.Memory)
+	// DebugConfig limits override standard config.
+	var limits struct {
+		CpuLimit    *int
+		MemoryLimit *int
+	}
+	if ok, err := config.GetDebugConfig("resourceLimits", &limits); err != nil {
+		log.Printf("[nspawn] %s", err)
+	} else if ok {
+		if limits.CpuLimit != nil {
+			a.cpuLimit = *limits.CpuLimit
+		}
+		if limits.MemoryLimit != nil {
+			a.memoryLimit = *limits.MemoryLimit
+		}
+	}
+
+	a.running = make(chan struct{}, 1)
+	a.name = config.JobstepID
+	a.dir = filepath.Join(machineDir, config.JobstepID)
+	a.config = config
+	return nil
+}
+
+// Prepare the environment for future commands. This is run before any
+// commands are processed and is run once.
+func (a *Adapter) Prepare(clientLog *client.Log) (client.Metrics, error) {
+	metrics := client.Metrics{}
+	if out, err := exec.Command("systemd-nspawn", "--version").Output(); err != nil {
+		return metrics, fmt.Errorf("Failed to run systemd-nspawn: %s", err)
+	} else {
+		clientLog.Printf("systemd-nspawn version: %s", strings.SplitN(string(out), "\n", 2)[0])
+	}
+
+	lower := baseImage
+	if a.snapshot != "" {
+		var err error
+		if lower, err = ensureImage(a.snapshot, clientLog, metrics); err != nil {
+			return metrics, err
+		}
+	}
+
+	timer := metrics.StartTimer()
+	upper, work := filepath.Join(a.dir, "upper"), filepath.Join(a.dir, "work")
+	for _, d := range []string{upper, work, a.GetRootFs()} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return metrics, err
+		}
+	}
+	clientLog.Printf("==> Creating overlay of %s at %s", lower, a.GetRootFs())
+	if err := syscall.Mount("overlay", a.GetRootFs(), "overlay", 0, autil.OverlayOptions([]string{lower}, upper, work)); err != nil {
+		return metrics, fmt.Errorf("Failed to mount overlay at %s: %s", a.GetRootFs(), err)
+	}
+	a.mounted = true
+	timer.Record("overlayCreationTime")
+
+	for _, binary := range mountedBinaries {
+		binaryPath, err := exec.LookPath(binary)
+		if err != nil {
+			log.Printf("[nspawn] Not making %s available in the container: %s", binary, err)
+			continue
+		}
+		if err := autil.CopyFile(binaryPath, filepath.Join(a.inputDir, binary), 0755); err != nil {
+			return metrics, err
+		}
+	}
+
+	a.artifactSource = filepath.Join(a.GetRootFs(), containerPath(a.config.ArtifactSearchPath))
+	return metrics, nil
+}
+
+// containerPath returns p as an absolute path within the container, where
+// relative paths are relative to the user's home directory.
+func containerPath(p string) string {
+	if filepath.IsAbs(p) {
+		return filepath.Clean(p)
+	}
+	return filepath.Join("/home", user, p)
+}
+
+// nspawnArgs returns the systemd-nspawn command line to run args in the
+// machine with the given name.
+func (a *Adapter) nspawnArgs(machine, cwd string, env []string, args ...string) []string {
+	res := []string{
+		"systemd-nspawn",
+		"--quiet",
+		// Gives the command a minimal init that reaps orphaned processes.
+		"--as-pid2",
+		// Keeps stdout and stderr separate rather than using a pty.
+		"--console=pipe",
+		"--directory=" + a.GetRootFs(),
+		"--machine=" + machine,
+		"--hostname=" + a.name + "-build",
+		"--user=" + user,
+		"--chdir=" + containerPath(cwd),
+	}
+	for _, m := range a.mounts {
+		opt := "--bind="
+		for _, o := range strings.Split(m.Options, ",") {
+			if o == "ro" {
+				opt = "--bind-ro="
+			}
+		}
+		res = append(res, opt+strings.TrimRight(m.Source, "/")+":/"+strings.Trim(m.Dest, "/"))
+	}
+	if a.cpuLimit != 0 {
+		res = append(res, fmt.Sprintf("--property=CPUQuota=%d%%", a.cpuLimit*100))
+	}
+	if a.memoryLimit != 0 {
+		res = append(res, fmt.Sprintf("--property=MemoryMax=%dM", a.memoryLimit))
+	}
+	for _, e := range env {
+		res = append(res, "--setenv="+e)
+	}
+	return append(append(res, "--"), args...)
+}
+
+// Run copies the command's script to the input directory and runs it with
+// systemd-nspawn in the overlay, as --nspawn-user and from its working
+// directory (relative to that user's home directory). Only one command runs
+// at a time, as systemd-nspawn locks the overlay while it runs.
+func (a *Adapter) Run(ctx context.Context, cmd *client.Command, clientLog *client.Log) (*client.CommandResult, error) {
+	script, err := ioutil.TempFile(a.inputDir, "script-")
+	if err != nil {
+		return nil, err
+	}
+	script.Close()
+	defer os.Remove(script.Name())
+	if err := autil.CopyFile(cmd.Path, script.Name(), 0755); err != nil {
+		return nil, err
+	}
+	mountedFile := filepath.Join(containerInputDirectory, filepath.Base(script.Name()))
+
+	select {
+	case a.running <- struct{}{}:
+	default:
+		clientLog.Printf("==> Waiting for another command to finish; the nspawn adapter runs one command at a time")
+		select {
+		case a.running <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	defer func() { <-a.running }()
+
+	// Each command's machine gets its own name, so that they can be told
+	// apart in machinectl and the journal.
+	machine := fmt.Sprintf("%s-%d", a.name, atomic.AddInt32(&a.runs, 1))
+	cw := client.NewCmdWrapper(a.nspawnArgs(machine, cmd.Cwd, cmd.Env, mountedFile), "", nil)
+	cw.KillGracePeriod = cmd.KillGracePeriod
+	cw.Stderr = cmd.Stderr
+	log.Printf("[nspawn] Running %s in machine %s", mountedFile, machine)
+	return cw.RunContext(ctx, cmd.CaptureOutput, clientLog)
+}
+
+// Should we keep the overlay around? As with the LXC adapter, it is kept if
+// the file KEEP-CONTAINER exists in the user's home directory.
+func (a *Adapter) shouldKeep() bool {
+	_, err := os.Stat(filepath.Join(a.GetRootFs(), containerPath("KEEP-CONTAINER")))
+	return err == nil
+}
+
+// Perform any cleanup actions within the environment.
+func (a *Adapter) Shutdown(clientLog *client.Log) (client.Metrics, error) {
+	if keepMachine || (a.mounted && a.shouldKeep()) {
+		clientLog.Printf("[nspawn] Keeping overlay %s", a.GetRootFs())
+		return nil, nil
+	}
+	if a.mounted {
+		if err := syscall.Unmount(a.GetRootFs(), 0); err != nil {
+			clientLog.Printf("[nspawn] Failed to unmount %s, detaching it instead: %s", a.GetRootFs(), err)
+			if err := syscall.Unmount(a.GetRootFs(), syscall.MNT_DETACH); err != nil {
+				return nil, err
+			}
+		}
+		a.mounted = false
+	}
+	if err := os.RemoveAll(a.dir); err != nil {
+		return nil, err
+	}
+	return nil, os.RemoveAll(a.inputDir)
+}
+
+// CaptureSnapshot saves the container's root filesystem as a snapshot image,
+// uploading it to S3 if a bucket was given.
+func (a *Adapter) CaptureSnapshot(outputSnapshot string, clientLog *client.Log) error {
+	outputSnapshot = adapter.FormatUUID(outputSnapshot)
+	if err := createImage(outputSnapshot, a.GetRootFs(), a.name, clientLog); err != nil {
+		return err
+	}
+	if s3Bucket == "" {
+		log.Printf("[nspawn] warning: cannot upload snapshot, no s3 bucket specified")
+		return nil
+	}
+	return uploadImage(outputSnapshot, clientLog)
+}
+
+func (a *Adapter) GetRootFs() string {
+	return filepath.Join(a.dir, "root")
+}
+
+func (a *Adapter) CollectArtifacts(artifacts []string, clientLog *client.Log) ([]string, error) {
+	log.Printf("[nspawn] Searching for %s in %s", artifacts, a.artifactSource)
+	return autil.CollectArtifactsIn(a.artifactSource, artifacts, clientLog)
+}
+
+func (a *Adapter) GetArtifactRoot() string {
+	return a.artifactSource
+}
+
+func New() adapter.Adapter {
+	return &Adapter{}
+}
+
+func init() {
+	adapter.Register("nspawn", New)
+}
@@ -0,0 +1,111 @@
+// +build linux
+
+package nspawnadapter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	autil "github.com/dropbox/changes-client/adapter"
+	"github.com/dropbox/changes-client/client"
+)
+
+func TestNspawnArgs(t *testing.T) {
+	user = "ubuntu"
+	a := &Adapter{
+		name: "js",
+		dir:  "/machines/js",
+		mounts: []*autil.BindMount{
+			{Source: "/input/", Dest: "var/changes/input", Options: "ro,create=dir"},
+			{Source: "/cache", Dest: "/cache", Options: "create=dir"},
+		},
+		cpuLimit:    4,
+		memoryLimit: 8192,
+	}
+	assert.Equal(t, []string{
+		"systemd-nspawn", "--quiet", "--as-pid2", "--console=pipe",
+		"--directory=/machines/js/root",
+		"--machine=js-1",
+		"--hostname=js-build",
+		"--user=ubuntu",
+		"--chdir=/home/ubuntu/src",
+		"--bind-ro=/input:/var/changes/input",
+		"--bind=/cache:/cache",
+		"--property=CPUQuota=400%",
+		"--property=MemoryMax=8192M",
+		"--setenv=A=b",
+		"--", "/var/changes/input/script",
+	}, a.nspawnArgs("js-1", "src", []string{"A=b"}, "/var/changes/input/script"))
+
+	a.cpuLimit, a.memoryLimit, a.mounts = 0, 0, nil
+	assert.Equal(t, []string{
+		"systemd-nspawn", "--quiet", "--as-pid2", "--console=pipe",
+		"--directory=/machines/js/root",
+		"--machine=js-2",
+		"--hostname=js-build",
+		"--user=ubuntu",
+		"--chdir=/tmp",
+		"--", "true",
+	}, a.nspawnArgs("js-2", "/tmp/", nil, "true"))
+}
+
+// A stand-in for systemd-nspawn that fails, as it does, if another instance
+// is using the same directory.
+const fakeNspawn = `#!/bin/sh
+for arg; do
+	case "$arg" in --directory=*) lock="${arg#--directory=}.lock" ;; esac
+done
+mkdir "$lock" 2>/dev/null || { echo "Directory tree is currently busy."; exit 1; }
+sleep 0.2
+rmdir "$lock"
+`
+
+func TestParallelRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nspawn-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "systemd-nspawn"), []byte(fakeNspawn), 0755))
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	defer func(d, i string) { machineDir, baseImage = d, i }(machineDir, baseImage)
+	machineDir, baseImage = dir, dir
+	config := &client.Config{JobstepID: "js"}
+	a := &Adapter{}
+	require.NoError(t, a.Init(config))
+	defer os.RemoveAll(a.inputDir)
+	require.NoError(t, os.MkdirAll(a.dir, 0755))
+	log := client.NewLog()
+	defer log.Close()
+	go log.Drain()
+
+	// As the engine runs a parallel group.
+	results := make([]*client.CommandResult, 3)
+	var wg sync.WaitGroup
+	for i := range results {
+		cmd, err := client.NewCommand(fmt.Sprintf("cmd%d", i), "#!/bin/sh\ntrue\n")
+		require.NoError(t, err)
+		defer os.Remove(cmd.Path)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, err := a.Run(context.Background(), cmd, log)
+			assert.NoError(t, err)
+			results[i] = r
+		}(i)
+	}
+	wg.Wait()
+	for i, r := range results {
+		if assert.NotNil(t, r) {
+			assert.True(t, r.Success, "command %d failed", i)
+		}
+	}
+}
@@ -0,0 +1,6 @@
+// +build !linux
+
+package nspawnadapter
+
+// This file is in place to make sure the 'nspawn' package can be built on non-Linux
+// machines. systemd-nspawn is only supported on Linux.
@@ -0,0 +1,36 @@
+package nspawnadapter
+
+import (
+	"flag"
+)
+
+// Flags are stored here so they are available even for non-Linux builds.
+var (
+	machineDir  string
+	imageDir    string
+	baseImage   string
+	s3Bucket    string
+	release     string
+	compression string
+	bindMounts  string
+	user        string
+	memory      int
+	cpus        int
+	keepMachine bool
+)
+
+func init() {
+	flag.StringVar(&machineDir, "nspawn-dir", "/var/lib/changes-client/machines", "Directory for the nspawn adapter's per-JobStep overlays")
+	// Snapshot images are stored here in the same layout as in S3 and the
+	// LXC download cache, so the same images work for both adapters.
+	flag.StringVar(&imageDir, "nspawn-image-dir", "/var/cache/changes-client/nspawn", "Directory for the nspawn adapter's snapshot images")
+	flag.StringVar(&baseImage, "nspawn-base-image", "", "Root filesystem directory for JobSteps without a snapshot")
+	flag.StringVar(&s3Bucket, "nspawn-s3-bucket", "", "S3 bucket name for the nspawn adapter's snapshot images")
+	flag.StringVar(&release, "nspawn-release", "trusty", "Distribution release of snapshot images")
+	flag.StringVar(&compression, "nspawn-compression", "lz4", "compression algorithm for snapshot images (xz,lz4)")
+	flag.StringVar(&bindMounts, "nspawn-bind-mounts", "", "bind mounts. <source>:<dest>:<options>. comma separated.")
+	flag.StringVar(&user, "nspawn-user", "ubuntu", "User to run commands as within the container")
+	flag.IntVar(&memory, "nspawn-memory", 0, "Memory limit (in MB)")
+	flag.IntVar(&cpus, "nspawn-cpus", 0, "CPU limit")
+	flag.BoolVar(&keepMachine, "keep-machine", false, "Do not remove the nspawn adapter's overlay on cleanup")
+}
@@ -0,0 +1,221 @@
+// +build linux
+
+package nspawnadapter
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dropbox/changes-client/client"
+	"github.com/dropbox/changes-client/common/lockfile"
+)
+
+const lockTimeout = 1 * time.Hour
+
+// Gets the path of a snapshot's image, relative to imageDir and the S3
+// bucket. This is the same as the LXC adapter's, so images can be shared.
+func imagePath(snapshot string) string {
+	return filepath.Join("ubuntu", release, "amd64", snapshot)
+}
+
+// Gets the directory a snapshot's image is extracted to.
+func imageRootFs(snapshot string) string {
+	return filepath.Join(imageDir, "rootfs", snapshot)
+}
+
+// Returns the compression type (xz or lz4) of the snapshot image in dir.
+// The second return value indicates success in determining the type.
+func imageCompressionType(dir string) (string, bool) {
+	for _, compressionType := range []string{"xz", "lz4"} {
+		if _, err := os.Stat(filepath.Join(dir, "rootfs.tar."+compressionType)); err == nil {
+			return compressionType, true
+		}
+	}
+	return "", false
+}
+
+func acquireLock(name string) (*lockfile.Lockfile, error) {
+	lock, err := lockfile.New(fmt.Sprintf("/tmp/nspawn-%s.lock", name))
+	if err != nil {
+		log.Printf("Cannot initialize lock: %s", err)
+		return nil, err
+	}
+
+	startTime := time.Now()
+	for {
+		if err := lock.TryLock(); err != nil {
+			if time.Since(startTime) > lockTimeout {
+				return nil, err
+			}
+
+			if err == lockfile.ErrBusy {
+				log.Printf(`Lock "%v" is busy - retrying in 3 seconds`, lock)
+				time.Sleep(3 * time.Second)
+				continue
+			}
+		} else {
+			return lock, nil
+		}
+	}
+}
+
+// ensureImage returns the directory the snapshot's image is extracted to,
+// downloading and extracting it first if needed. Once extracted, the
+// downloaded tarball is removed to save disk space.
+func ensureImage(snapshot string, clientLog *client.Log, metrics client.Metrics) (string, error) {
+	rootfs := imageRootFs(snapshot)
+
+	clientLog.Printf("==> Acquiring lock on image: %s", snapshot)
+	lock, err := acquireLock(snapshot)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		clientLog.Printf("==> Releasing lock on image: %s", snapshot)
+		lock.Unlock()
+	}()
+
+	if _, err := os.Stat(rootfs); err == nil {
+		clientLog.Printf("==> Using existing image: %s", snapshot)
+		return rootfs, nil
+	}
+
+	localPath := filepath.Join(imageDir, imagePath(snapshot))
+	compressionType, ok := imageCompressionType(localPath)
+	if !ok {
+		if s3Bucket == "" {
+			return "", errors.New("Unable to find cached image, and no S3 bucket defined.")
+		}
+		if err := os.MkdirAll(localPath, 0755); err != nil {
+			return "", err
+		}
+		clientLog.Printf("==> Downloading image %s", snapshot)
+		timer := metrics.StartTimer()
+		remotePath := fmt.Sprintf("s3://%s/%s", s3Bucket, imagePath(snapshot))
+		cw := client.NewCmdWrapper([]string{"aws", "s3", "sync", "--quiet", remotePath, localPath}, "", []string{
+			"HOME=/root",
+		})
+		result, err := cw.Run(false, clientLog)
+		if err != nil {
+			return "", err
+		}
+		if !result.Success {
+			return "", errors.New("Failed downloading image")
+		}
+		timer.Record("snapshotImageDownloadTime")
+		if compressionType, ok = imageCompressionType(localPath); !ok {
+			return "", errors.New("Failed to determine compression type of downloaded image.")
+		}
+	}
+
+	clientLog.Printf("==> Extracting image %s", snapshot)
+	defer metrics.StartTimer().Record("snapshotImageExtractionTime")
+	tmp := rootfs + ".partial"
+	if err := os.RemoveAll(tmp); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return "", err
+	}
+	tarball := filepath.Join(localPath, "rootfs.tar."+compressionType)
+	args := []string{"tar", "-xf", tarball, "-C", tmp, "--numeric-owner"}
+	if compressionType == "xz" {
+		args = append(args, "-J")
+	} else {
+		args = append(args, "-I", compressionType)
+	}
+	result, err := client.NewCmdWrapper(args, "", nil).Run(false, clientLog)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if !result.Success {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("Failed extracting %s", tarball)
+	}
+	if err := os.Rename(tmp, rootfs); err != nil {
+		return "", err
+	}
+	// Note that this won't fail if the download doesn't exist, which is
+	// the desired behavior.
+	os.RemoveAll(localPath)
+	return rootfs, nil
+}
+
+// createImage saves rootfs as the snapshot's image, in the same format as
+// the LXC adapter so that either adapter can use it.
+func createImage(snapshot, rootfs, name string, clientLog *client.Log) error {
+	dest := filepath.Join(imageDir, imagePath(snapshot))
+	clientLog.Printf("==> Saving snapshot to %s", dest)
+	start := time.Now()
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	metadata := map[string]string{
+		"config": "lxc.include = LXC_TEMPLATE_CONFIG/ubuntu.common.conf\n" +
+			"lxc.include = LXC_TEMPLATE_CONFIG/nesting.conf\n" +
+			"lxc.arch = x86_64\n",
+		"snapshot_id": name + "\n",
+	}
+	for file, content := range metadata {
+		path := filepath.Join(dest, file)
+		// The files are read-only, so replace rather than overwrite them.
+		os.Remove(path)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0440)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteString(content)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	clientLog.Printf("==> Creating rootfs.tar.%s", compression)
+	rootFsTar := filepath.Join(dest, "rootfs.tar."+compression)
+	var cw *client.CmdWrapper
+	if compression == "xz" {
+		cw = client.NewCmdWrapper([]string{"tar", "-Jcf", rootFsTar, "-C", rootfs, "."}, "", nil)
+	} else {
+		cw = client.NewCmdWrapper([]string{"tar", "-cf", rootFsTar, "-I", "lz4", "-C", rootfs, "."}, "", nil)
+	}
+	result, err := cw.Run(false, clientLog)
+	if err != nil {
+		return err
+	}
+	if !result.Success {
+		return fmt.Errorf("Failed creating rootfs.tar.%s", compression)
+	}
+
+	clientLog.Printf("==> Snapshot created in %s", time.Since(start))
+	return nil
+}
+
+// Uploads a snapshot image to the S3 bucket, at the path it is downloaded
+// from.
+func uploadImage(snapshot string, clientLog *client.Log) error {
+	localPath := filepath.Join(imageDir, imagePath(snapshot))
+	remotePath := fmt.Sprintf("s3://%s/%s", s3Bucket, imagePath(snapshot))
+
+	clientLog.Printf("==> Uploading image %s", snapshot)
+	cw := client.NewCmdWrapper([]string{"aws", "s3", "sync", localPath, remotePath}, "", nil)
+
+	start := time.Now()
+	result, err := cw.Run(false, clientLog)
+	if err != nil {
+		return err
+	}
+	if !result.Success {
+		return errors.New("Failed uploading image")
+	}
+	clientLog.Printf("==> Image uploaded in %s", time.Since(start))
+	return nil
+}
@@ -0,0 +1,342 @@
+// +build linux
+
+package ociadapter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	autil "github.com/dropbox/changes-client/adapter"
+	"github.com/dropbox/changes-client/client"
+	"github.com/dropbox/changes-client/client/adapter"
+	"github.com/dropbox/changes-client/common/lockfile"
+)
+
+// The directory in which the container can access files that are copied into
+// the adapter's inputDir, as with the LXC adapter.
+const containerInputDirectory = "/var/changes/input"
+
+const lockTimeout = 10 * time.Minute
+
+// Adapter runs each command in a container, created with an OCI runtime from
+// a bundle whose root filesystem is an overlay of an image from an OCI image
+// layout. Commands see each other's changes, but the image is never
+// modified. Snapshots are saved to the layout as a new layer on top of the
+// image, named with the snapshot's ID.
+type Adapter struct {
+	config   *client.Config
+	name     string
+	image    layout
+	manifest *imageManifest
+	// Where the manifest's layers are unpacked.
+	imageRootFs string
+	imageConfig imageConfig
+	// Holds the overlay's upper, work and mount point directories, and the
+	// bundle directories of commands.
+	dir string
+	// Host directory mounted at containerInputDirectory.
+	inputDir       string
+	mounts         []*autil.BindMount
+	mounted        bool
+	artifactSource string
+	runs           int32
+	cpuLimit       int
+	memoryLimit    int
+}
+
+func (a *Adapter) Init(config *client.Config) error {
+	if imageDir == "" {
+		return errors.New("The oci adapter requires --oci-image")
+	}
+	a.image = layout(imageDir)
+	ref := imageRef
+	if config.Snapshot.ID != "" {
+		ref = adapter.FormatUUID(config.Snapshot.ID)
+	}
+	desc, manifest, err := a.image.resolve(ref)
+	if err != nil {
+		return err
+	}
+	if err := a.image.readJSON(manifest.Config, &a.imageConfig); err != nil {
+		return fmt.Errorf("Failed to read image config: %s", err)
+	}
+	a.manifest = manifest
+	a.imageRootFs = filepath.Join(cacheDir, strings.TrimPrefix(desc.Digest, "sha256:"))
+
+	extraMounts, err := autil.ParseBindMounts(bindMounts)
+	if err != nil {
+		return err
+	}
+	inputDir, err := ioutil.TempDir("", "changes-client-input-")
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(inputDir, 0755); err != nil {
+		return err
+	}
+	inputMount := &autil.BindMount{Source: inputDir, Dest: containerInputDirectory, Options: "ro"}
+	a.mounts = append([]*autil.BindMount{inputMount}, extraMounts...)
+	a.inputDir = inputDir
+
+	a.cpuLimit, a.memoryLimit = resourceLimits(config)
+	a.name = config.JobstepID
+	a.dir = filepath.Join(bundleDir, config.JobstepID)
+	a.config = config
+	return nil
+}
+
+// resourceLimits returns the CPU and memory limits for commands, where zero
+// means no limit.
+func resourceLimits(config *client.Config) (cpus, memory int) {
+	cpus = autil.MergeLimits(0, config.ResourceLimits.Cpus)
+	memory = autil.MergeLimits(0, config.ResourceLimits.Memory)
+	// DebugConfig limits override standard config.
+	var limits struct {
+		CpuLimit    *int
+		MemoryLimit *int
+	}
+	if ok, err := config.GetDebugConfig("resourceLimits", &limits); err != nil {
+		log.Printf("[oci] %s", err)
+	} else if ok {
+		if limits.CpuLimit != nil {
+			cpus = *limits.CpuLimit
+		}
+		if limits.MemoryLimit != nil {
+			memory = *limits.MemoryLimit
+		}
+	}
+	return cpus, memory
+}
+
+// ensureUnpacked unpacks the image's layers, unless a previous JobStep
+// already did.
+func (a *Adapter) ensureUnpacked(clientLog *client.Log, metrics client.Metrics) error {
+	if _, err := os.Stat(a.imageRootFs); err == nil {
+		clientLog.Printf("==> Using unpacked image %s", a.imageRootFs)
+		return nil
+	}
+	clientLog.Printf("==> Unpacking image to %s", a.imageRootFs)
+	defer metrics.StartTimer().Record("imageUnpackTime")
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return err
+	}
+	// JobSteps unpacking the same image at once each use their own
+	// directory, and the first to finish wins.
+	tmp, err := ioutil.TempDir(cacheDir, filepath.Base(a.imageRootFs)+".partial-")
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+	if err := a.image.unpack(a.manifest, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, a.imageRootFs); err != nil {
+		os.RemoveAll(tmp)
+		if _, serr := os.Stat(a.imageRootFs); serr != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prepare the environment for future commands. This is run before any
+// commands are processed and is run once.
+func (a *Adapter) Prepare(clientLog *client.Log) (client.Metrics, error) {
+	metrics := client.Metrics{}
+	if out, err := exec.Command(ociRuntime, "--version").Output(); err != nil {
+		return metrics, fmt.Errorf("Failed to run %s: %s", ociRuntime, err)
+	} else {
+		clientLog.Printf("%s version: %s", ociRuntime, strings.SplitN(string(out), "\n", 2)[0])
+	}
+	if err := a.ensureUnpacked(clientLog, metrics); err != nil {
+		return metrics, err
+	}
+
+	upper, work := filepath.Join(a.dir, "upper"), filepath.Join(a.dir, "work")
+	for _, d := range []string{upper, work, a.GetRootFs()} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return metrics, err
+		}
+	}
+	options := autil.OverlayOptions([]string{a.imageRootFs}, upper, work)
+	if err := syscall.Mount("overlay", a.GetRootFs(), "overlay", 0, options); err != nil {
+		return metrics, fmt.Errorf("Failed to mount overlay at %s: %s", a.GetRootFs(), err)
+	}
+	a.mounted = true
+
+	a.artifactSource = filepath.Join(a.GetRootFs(), a.containerPath(a.config.ArtifactSearchPath))
+	return metrics, nil
+}
+
+// containerPath returns p as an absolute path within the container, where
+// relative paths are relative to the image's working directory.
+func (a *Adapter) containerPath(p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	return path.Join("/", a.imageConfig.Config.WorkingDir, p)
+}
+
+// Run copies the command's script to the input directory and runs it with
+// the OCI runtime, in a bundle of its own whose spec combines the image's
+// config with the command's environment and working directory. If the
+// command is cancelled, the container is deleted in case it outlives the
+// runtime.
+func (a *Adapter) Run(ctx context.Context, cmd *client.Command, clientLog *client.Log) (*client.CommandResult, error) {
+	n := atomic.AddInt32(&a.runs, 1)
+	id := fmt.Sprintf("%s-%d", a.name, n)
+
+	script, err := ioutil.TempFile(a.inputDir, "script-")
+	if err != nil {
+		return nil, err
+	}
+	script.Close()
+	defer os.Remove(script.Name())
+	if err := autil.CopyFile(cmd.Path, script.Name(), 0755); err != nil {
+		return nil, err
+	}
+	mountedFile := path.Join(containerInputDirectory, filepath.Base(script.Name()))
+
+	user, err := lookupUser(a.GetRootFs(), a.imageConfig.Config.User)
+	if err != nil {
+		return nil, err
+	}
+	cwd := a.containerPath(cmd.Cwd)
+	if hostCwd, err := secureJoin(a.GetRootFs(), cwd); err != nil {
+		return nil, err
+	} else if err := os.MkdirAll(hostCwd, 0755); err != nil {
+		return nil, err
+	}
+	s := newSpec(a.GetRootFs(), a.name+"-build", user, []string{mountedFile},
+		mergeEnv(a.imageConfig.Config.Env, cmd.Env), cwd, a.mounts, a.cpuLimit, a.memoryLimit)
+
+	// Commands in a parallel group run at the same time, so each gets its
+	// own bundle.
+	bundle := filepath.Join(a.dir, "bundles", strconv.Itoa(int(n)))
+	if err := os.MkdirAll(bundle, 0755); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(bundle)
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundle, "config.json"), data, 0644); err != nil {
+		return nil, err
+	}
+
+	cw := client.NewCmdWrapper([]string{ociRuntime, "run", "--bundle", bundle, id}, "", nil)
+	cw.KillGracePeriod = cmd.KillGracePeriod
+	cw.Stderr = cmd.Stderr
+	log.Printf("[oci] Running %s in container %s", mountedFile, id)
+	result, err := cw.RunContext(ctx, cmd.CaptureOutput, clientLog)
+	if ctx.Err() != nil {
+		// The container can outlive a runtime that was killed.
+		if out, err := exec.Command(ociRuntime, "delete", "--force", id).CombinedOutput(); err != nil {
+			log.Printf("[oci] Failed to delete container %s: %s: %s", id, err, out)
+		}
+	}
+	return result, err
+}
+
+// Perform any cleanup actions within the environment.
+func (a *Adapter) Shutdown(clientLog *client.Log) (client.Metrics, error) {
+	if keepBundle {
+		clientLog.Printf("[oci] Keeping bundle %s", a.dir)
+		return nil, nil
+	}
+	if a.mounted {
+		if err := syscall.Unmount(a.GetRootFs(), 0); err != nil {
+			clientLog.Printf("[oci] Failed to unmount %s, detaching it instead: %s", a.GetRootFs(), err)
+			if err := syscall.Unmount(a.GetRootFs(), syscall.MNT_DETACH); err != nil {
+				return nil, err
+			}
+		}
+		a.mounted = false
+	}
+	if err := os.RemoveAll(a.dir); err != nil {
+		return nil, err
+	}
+	return nil, os.RemoveAll(a.inputDir)
+}
+
+func lockLayout(l layout) (*lockfile.Lockfile, error) {
+	abs, err := filepath.Abs(filepath.Join(string(l), "index.json.lock"))
+	if err != nil {
+		return nil, err
+	}
+	lock, err := lockfile.New(abs)
+	if err != nil {
+		return nil, err
+	}
+	startTime := time.Now()
+	for {
+		err := lock.TryLock()
+		if err == nil {
+			return lock, nil
+		}
+		if err != lockfile.ErrBusy || time.Since(startTime) > lockTimeout {
+			return nil, err
+		}
+		log.Printf(`Lock "%v" is busy - retrying in 1 second`, lock)
+		time.Sleep(time.Second)
+	}
+}
+
+// CaptureSnapshot saves the changes commands made to the root filesystem as
+// a new layer on top of the image, named with the snapshot's ID in the
+// image layout.
+func (a *Adapter) CaptureSnapshot(outputSnapshot string, clientLog *client.Log) error {
+	outputSnapshot = adapter.FormatUUID(outputSnapshot)
+	clientLog.Printf("==> Saving snapshot %s to %s", outputSnapshot, a.image)
+	start := time.Now()
+	lock, err := lockLayout(a.image)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	createdBy := fmt.Sprintf("changes-client snapshot of jobstep %s", a.name)
+	if err := a.image.addLayer(a.manifest, filepath.Join(a.dir, "upper"), outputSnapshot, createdBy); err != nil {
+		return err
+	}
+	clientLog.Printf("==> Snapshot created in %s", time.Since(start))
+	return nil
+}
+
+func (a *Adapter) GetRootFs() string {
+	return filepath.Join(a.dir, "rootfs")
+}
+
+func (a *Adapter) CollectArtifacts(artifacts []string, clientLog *client.Log) ([]string, error) {
+	log.Printf("[oci] Searching for %s in %s", artifacts, a.artifactSource)
+	return autil.CollectArtifactsIn(a.artifactSource, artifacts, clientLog)
+}
+
+func (a *Adapter) GetArtifactRoot() string {
+	return a.artifactSource
+}
+
+func New() adapter.Adapter {
+	return &Adapter{}
+}
+
+func init() {
+	adapter.Register("oci", New)
+}
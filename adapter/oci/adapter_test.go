@@ -0,0 +1,31 @@
+// +build linux
+
+package ociadapter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/changes-client/client"
+)
+
+func TestResourceLimits(t *testing.T) {
+	config, err := client.LoadConfig([]byte(`{"resourceLimits": {"cpus": 4, "memory": 8000}}`))
+	require.NoError(t, err)
+	cpus, memory := resourceLimits(config)
+	assert.Equal(t, 4, cpus)
+	assert.Equal(t, 8000, memory)
+
+	config, err = client.LoadConfig([]byte(`{"resourceLimits": {"cpus": 4, "memory": 8000},
+		"debugConfig": {"resourceLimits": {"cpuLimit": 8}}}`))
+	require.NoError(t, err)
+	cpus, memory = resourceLimits(config)
+	assert.Equal(t, 8, cpus)
+	assert.Equal(t, 8000, memory)
+
+	cpus, memory = resourceLimits(&client.Config{})
+	assert.Equal(t, 0, cpus)
+	assert.Equal(t, 0, memory)
+}
@@ -0,0 +1,6 @@
+// +build !linux
+
+package ociadapter
+
+// This file is in place to make sure the 'oci' package can be built on non-Linux
+// machines. OCI runtimes are only supported on Linux.
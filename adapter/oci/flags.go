@@ -0,0 +1,26 @@
+package ociadapter
+
+import (
+	"flag"
+)
+
+// Flags are stored here so they are available even for non-Linux builds.
+var (
+	imageDir   string
+	imageRef   string
+	ociRuntime string
+	bundleDir  string
+	cacheDir   string
+	bindMounts string
+	keepBundle bool
+)
+
+func init() {
+	flag.StringVar(&imageDir, "oci-image", "", "OCI image layout directory for the oci adapter, which snapshots are also saved to")
+	flag.StringVar(&imageRef, "oci-ref", "", "Reference name of the image in --oci-image to use for JobSteps without a snapshot (may be omitted if there is only one)")
+	flag.StringVar(&ociRuntime, "oci-runtime", "runc", "OCI runtime binary to run commands with")
+	flag.StringVar(&bundleDir, "oci-dir", "/var/lib/changes-client/bundles", "Directory for the oci adapter's per-JobStep bundles")
+	flag.StringVar(&cacheDir, "oci-cache-dir", "/var/cache/changes-client/oci", "Directory for the oci adapter's unpacked images")
+	flag.StringVar(&bindMounts, "oci-bind-mounts", "", "bind mounts. <source>:<dest>:<options>. comma separated.")
+	flag.BoolVar(&keepBundle, "keep-bundle", false, "Do not remove the oci adapter's bundle on cleanup")
+}
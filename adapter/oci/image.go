@@ -0,0 +1,588 @@
+// +build linux
+
+package ociadapter
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	refNameAnnotation  = "org.opencontainers.image.ref.name"
+	mediaTypeManifest  = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeConfig    = "application/vnd.oci.image.config.v1+json"
+	mediaTypeLayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+var digestPattern = regexp.MustCompile(`^sha256:([a-f0-9]{64})$`)
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *json.RawMessage  `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type imageIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []descriptor      `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type imageManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        descriptor        `json:"config"`
+	Layers        []descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// imageConfig holds the parts of an image's configuration that commands
+// are run with.
+type imageConfig struct {
+	Config struct {
+		User       string
+		Env        []string
+		WorkingDir string
+	} `json:"config"`
+}
+
+// layout is an OCI image layout directory.
+type layout string
+
+func (l layout) blobPath(digest string) (string, error) {
+	m := digestPattern.FindStringSubmatch(digest)
+	if m == nil {
+		return "", fmt.Errorf("Unsupported digest %q", digest)
+	}
+	return filepath.Join(string(l), "blobs", "sha256", m[1]), nil
+}
+
+// openBlob returns the blob desc refers to. The digest is checked when the
+// returned reader reaches EOF.
+func (l layout) openBlob(desc descriptor) (io.ReadCloser, error) {
+	p, err := l.blobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{f: f, h: sha256.New(), digest: desc.Digest}, nil
+}
+
+type verifyingReader struct {
+	f      *os.File
+	h      hash.Hash
+	digest string
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF {
+		if got := "sha256:" + hex.EncodeToString(r.h.Sum(nil)); got != r.digest {
+			return n, fmt.Errorf("Blob %s has digest %s", r.digest, got)
+		}
+	}
+	return n, err
+}
+
+func (r *verifyingReader) Close() error {
+	return r.f.Close()
+}
+
+func (l layout) readJSON(desc descriptor, v interface{}) error {
+	r, err := l.openBlob(desc)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (l layout) index() (*imageIndex, error) {
+	data, err := ioutil.ReadFile(filepath.Join(string(l), "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	var idx imageIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("Malformed index.json in %s: %s", l, err)
+	}
+	return &idx, nil
+}
+
+// resolve returns the descriptor and contents of the manifest with the
+// given reference name. If ref is empty, the index must hold exactly one
+// manifest.
+func (l layout) resolve(ref string) (descriptor, *imageManifest, error) {
+	idx, err := l.index()
+	if err != nil {
+		return descriptor{}, nil, err
+	}
+	var found []descriptor
+	for _, d := range idx.Manifests {
+		if ref == "" || d.Annotations[refNameAnnotation] == ref {
+			found = append(found, d)
+		}
+	}
+	switch {
+	case len(found) == 0:
+		return descriptor{}, nil, fmt.Errorf("No image named %q in %s", ref, l)
+	case len(found) > 1 && ref == "":
+		return descriptor{}, nil, fmt.Errorf("%s has %d images, so a reference name is required", l, len(found))
+	case found[0].MediaType != mediaTypeManifest:
+		return descriptor{}, nil, fmt.Errorf("Unsupported media type %s for image %q", found[0].MediaType, ref)
+	}
+	var m imageManifest
+	if err := l.readJSON(found[0], &m); err != nil {
+		return descriptor{}, nil, fmt.Errorf("Failed to read manifest %s: %s", found[0].Digest, err)
+	}
+	return found[0], &m, nil
+}
+
+// commitBlob stores the file at tmp, which must be in the directory
+// blobTempFile creates files in, as the blob with the given digest.
+func (l layout) commitBlob(tmp, digest string) error {
+	p, err := l.blobPath(digest)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (l layout) blobTempFile() (*os.File, error) {
+	dir := filepath.Join(string(l), "blobs", "sha256")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(dir, ".tmp-")
+}
+
+// writeBlob stores data as a blob and returns its descriptor.
+func (l layout) writeBlob(mediaType string, data []byte) (descriptor, error) {
+	f, err := l.blobTempFile()
+	if err != nil {
+		return descriptor{}, err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return descriptor{}, err
+	}
+	sum := sha256.Sum256(data)
+	desc := descriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(data))}
+	if err := l.commitBlob(f.Name(), desc.Digest); err != nil {
+		os.Remove(f.Name())
+		return descriptor{}, err
+	}
+	return desc, nil
+}
+
+func (l layout) writeJSON(mediaType string, v interface{}) (descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return descriptor{}, err
+	}
+	return l.writeBlob(mediaType, data)
+}
+
+// tag points ref at the manifest desc, replacing any image already named ref.
+func (l layout) tag(ref string, desc descriptor) error {
+	idx, err := l.index()
+	if err != nil {
+		return err
+	}
+	manifests := idx.Manifests[:0]
+	for _, d := range idx.Manifests {
+		if d.Annotations[refNameAnnotation] != ref {
+			manifests = append(manifests, d)
+		}
+	}
+	desc.Annotations = map[string]string{refNameAnnotation: ref}
+	idx.Manifests = append(manifests, desc)
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(string(l), ".index.json.tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(string(l), "index.json"))
+}
+
+// unpack extracts the manifest's layers, in order, into root.
+func (l layout) unpack(m *imageManifest, root string) error {
+	for _, desc := range m.Layers {
+		r, err := l.openBlob(desc)
+		if err != nil {
+			return err
+		}
+		err = unpackLayer(root, r)
+		if err == nil {
+			// Reads to the end, so the digest is checked.
+			_, err = io.Copy(ioutil.Discard, r)
+		}
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to unpack layer %s: %s", desc.Digest, err)
+		}
+	}
+	return nil
+}
+
+// secureJoin returns the host path of p within root, resolving symlinks in
+// p as if root were the root directory, so that the result is always
+// within root. Missing path components are taken as they are.
+func secureJoin(root, p string) (string, error) {
+	resolved := ""
+	rest := p
+	links := 0
+	for rest != "" {
+		var part string
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			part, rest = rest[:i], rest[i+1:]
+		} else {
+			part, rest = rest, ""
+		}
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if resolved = path.Dir(resolved); resolved == "." || resolved == "/" {
+				resolved = ""
+			}
+			continue
+		}
+		next := path.Join(resolved, part)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > 255 {
+			return "", fmt.Errorf("Too many levels of symbolic links in %s", p)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = ""
+		}
+		rest = target + "/" + rest
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// unpackLayer extracts a layer, which may be gzipped, into root, applying
+// its whiteouts to what previous layers extracted.
+func unpackLayer(root string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	r = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		dir, base := path.Split(name)
+		parent, err := secureJoin(root, dir)
+		if err != nil {
+			return err
+		}
+		switch {
+		case base == whiteoutOpaque:
+			// Hides everything lower layers put in the directory.
+			entries, err := ioutil.ReadDir(parent)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			for _, e := range entries {
+				if err := os.RemoveAll(filepath.Join(parent, e.Name())); err != nil {
+					return err
+				}
+			}
+		case strings.HasPrefix(base, whiteoutPrefix):
+			if err := os.RemoveAll(filepath.Join(parent, strings.TrimPrefix(base, whiteoutPrefix))); err != nil {
+				return err
+			}
+		default:
+			if err := os.MkdirAll(parent, 0755); err != nil {
+				return err
+			}
+			if err := extractEntry(root, filepath.Join(parent, base), hdr, tr); err != nil {
+				return fmt.Errorf("Failed to extract %s: %s", hdr.Name, err)
+			}
+		}
+	}
+}
+
+func mkdev(major, minor int64) int {
+	return int((minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32))
+}
+
+func extractEntry(root, target string, hdr *tar.Header, r io.Reader) error {
+	// Replaces whatever lower layers had here, unless both are directories.
+	if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+		return os.Lchown(target, hdr.Uid, hdr.Gid)
+	case tar.TypeLink:
+		dir, base := path.Split(path.Clean("/" + hdr.Linkname))
+		parent, err := secureJoin(root, dir)
+		if err != nil {
+			return err
+		}
+		// Shares its metadata with the file it links to.
+		return os.Link(filepath.Join(parent, base), target)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		fileType := map[byte]uint32{
+			tar.TypeChar:  syscall.S_IFCHR,
+			tar.TypeBlock: syscall.S_IFBLK,
+			tar.TypeFifo:  syscall.S_IFIFO,
+		}[hdr.Typeflag]
+		if err := syscall.Mknod(target, fileType|mode, mkdev(hdr.Devmajor, hdr.Devminor)); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	// After chown, which clears setuid and setgid bits.
+	if err := syscall.Chmod(target, mode); err != nil {
+		return err
+	}
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "SCHILY.xattr.") {
+			// Best effort, as not every filesystem supports every namespace.
+			syscall.Setxattr(target, strings.TrimPrefix(k, "SCHILY.xattr."), []byte(v), 0)
+		}
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
+
+// isWhiteout reports whether fi is an overlayfs whiteout, which hides the
+// file of the same name in lower directories.
+func isWhiteout(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && fi.Mode()&os.ModeCharDevice != 0 && st.Rdev == 0
+}
+
+// isOpaque reports whether the directory at p is an overlayfs opaque
+// directory, which hides the contents of lower directories of the same name.
+func isOpaque(p string) bool {
+	buf := make([]byte, 1)
+	for _, attr := range []string{"trusted.overlay.opaque", "user.overlay.opaque"} {
+		if n, err := syscall.Getxattr(p, attr, buf); err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// writeLayer writes the overlayfs upper directory upper as a layer tarball,
+// turning its whiteouts and opaque directories into OCI whiteouts.
+func writeLayer(upper string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(upper, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upper, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if isWhiteout(fi) {
+			return tw.WriteHeader(&tar.Header{
+				Name:     path.Join(path.Dir(name), whiteoutPrefix+path.Base(name)),
+				Typeflag: tar.TypeReg,
+				Mode:     0600,
+				ModTime:  fi.ModTime(),
+			})
+		}
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		// The names are the host's, which may differ from the image's.
+		hdr.Uname, hdr.Gname = "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.IsDir() && isOpaque(p) {
+			return tw.WriteHeader(&tar.Header{
+				Name:     path.Join(name, whiteoutOpaque),
+				Typeflag: tar.TypeReg,
+				Mode:     0600,
+				ModTime:  fi.ModTime(),
+			})
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// addLayer saves the changes in the overlayfs upper directory upper as a
+// new layer on top of the image base, and names the resulting image ref.
+func (l layout) addLayer(base *imageManifest, upper, ref, createdBy string) error {
+	f, err := l.blobTempFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	compressed, uncompressed := sha256.New(), sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(f, compressed)}
+	gz := gzip.NewWriter(counter)
+	err = writeLayer(upper, io.MultiWriter(gz, uncompressed))
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write layer: %s", err)
+	}
+	layer := descriptor{
+		MediaType: mediaTypeLayerGzip,
+		Digest:    "sha256:" + hex.EncodeToString(compressed.Sum(nil)),
+		Size:      counter.n,
+	}
+	if err := l.commitBlob(f.Name(), layer.Digest); err != nil {
+		return err
+	}
+
+	// The configuration is kept as generic JSON so that fields this
+	// doesn't know about are preserved.
+	var config map[string]interface{}
+	if err := l.readJSON(base.Config, &config); err != nil {
+		return fmt.Errorf("Failed to read image config: %s", err)
+	}
+	rootfs, _ := config["rootfs"].(map[string]interface{})
+	if rootfs == nil {
+		rootfs = map[string]interface{}{"type": "layers"}
+	}
+	diffIDs, _ := rootfs["diff_ids"].([]interface{})
+	rootfs["diff_ids"] = append(diffIDs, "sha256:"+hex.EncodeToString(uncompressed.Sum(nil)))
+	config["rootfs"] = rootfs
+	created := time.Now().UTC().Format(time.RFC3339)
+	history, _ := config["history"].([]interface{})
+	config["history"] = append(history, map[string]interface{}{"created": created, "created_by": createdBy})
+	config["created"] = created
+	configDesc, err := l.writeJSON(mediaTypeConfig, config)
+	if err != nil {
+		return err
+	}
+
+	m := *base
+	m.Config = configDesc
+	m.Layers = append(append([]descriptor{}, base.Layers...), layer)
+	manifestDesc, err := l.writeJSON(mediaTypeManifest, m)
+	if err != nil {
+		return err
+	}
+	return l.tag(ref, manifestDesc)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,221 @@
+// +build linux
+
+package ociadapter
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type entry struct {
+	name, content, link string
+	typeflag            byte
+}
+
+func layerTar(t *testing.T, entries []entry) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.link, Mode: 0644,
+			Uid: os.Getuid(), Gid: os.Getgid(), Size: int64(len(e.content))}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(e.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+// newLayout creates an image layout holding an image named ref with the
+// given layers.
+func newLayout(t *testing.T, ref string, layers ...[]entry) layout {
+	dir, err := ioutil.TempDir("", "oci-layout-")
+	require.NoError(t, err)
+	l := layout(dir)
+	config := map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       map[string]interface{}{"Env": []string{"PATH=/bin"}, "WorkingDir": "/src"},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{}},
+	}
+	configDesc, err := l.writeJSON(mediaTypeConfig, config)
+	require.NoError(t, err)
+	m := imageManifest{SchemaVersion: 2, MediaType: mediaTypeManifest, Config: configDesc}
+	for _, entries := range layers {
+		desc, err := l.writeBlob(mediaTypeLayerGzip, layerTar(t, entries))
+		require.NoError(t, err)
+		m.Layers = append(m.Layers, desc)
+	}
+	manifestDesc, err := l.writeJSON(mediaTypeManifest, m)
+	require.NoError(t, err)
+	data, err := json.Marshal(imageIndex{SchemaVersion: 2})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.json"), data, 0644))
+	require.NoError(t, l.tag(ref, manifestDesc))
+	return l
+}
+
+func readFile(t *testing.T, p string) string {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+	return string(data)
+}
+
+func TestSecureJoin(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-root-")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "usr/lib"), 0755))
+	require.NoError(t, os.Symlink("usr/lib", filepath.Join(root, "lib")))
+	require.NoError(t, os.Symlink("/usr", filepath.Join(root, "abs")))
+	require.NoError(t, os.Symlink("../../..", filepath.Join(root, "usr/up")))
+
+	for p, expected := range map[string]string{
+		"/lib/x":       "usr/lib/x",
+		"abs/lib":      "usr/lib",
+		"/usr/up/etc":  "etc",
+		"../../etc":    "etc",
+		"/missing/a/b": "missing/a/b",
+	} {
+		res, err := secureJoin(root, p)
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(root, expected), res, p)
+	}
+
+	require.NoError(t, os.Symlink("loop", filepath.Join(root, "loop")))
+	_, err = secureJoin(root, "/loop/x")
+	assert.Error(t, err)
+}
+
+func TestUnpack(t *testing.T) {
+	l := newLayout(t, "base",
+		[]entry{
+			{name: "a/", typeflag: tar.TypeDir},
+			{name: "a/x", content: "x"},
+			{name: "a/y", content: "y"},
+			{name: "d/", typeflag: tar.TypeDir},
+			{name: "d/old", content: "old"},
+			{name: "link", link: "/a", typeflag: tar.TypeSymlink},
+			{name: "escape", link: "../../../..", typeflag: tar.TypeSymlink},
+		},
+		[]entry{
+			{name: "a/.wh.x"},
+			{name: "d/", typeflag: tar.TypeDir},
+			{name: "d/.wh..wh..opq"},
+			{name: "d/new", content: "new"},
+			{name: "link/via-link", content: "via"},
+			{name: "escape/tmp/evil", content: "evil"},
+			{name: "hard", link: "a/y", typeflag: tar.TypeLink},
+		},
+	)
+	defer os.RemoveAll(string(l))
+
+	_, m, err := l.resolve("base")
+	require.NoError(t, err)
+	root, err := ioutil.TempDir("", "oci-root-")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	require.NoError(t, l.unpack(m, root))
+
+	assert.Equal(t, "<open "+filepath.Join(root, "a/x")+": no such file or directory>", readFile(t, filepath.Join(root, "a/x")))
+	assert.Equal(t, "y", readFile(t, filepath.Join(root, "a/y")))
+	assert.Equal(t, "y", readFile(t, filepath.Join(root, "hard")))
+	assert.Equal(t, "via", readFile(t, filepath.Join(root, "a/via-link")))
+	assert.Equal(t, "evil", readFile(t, filepath.Join(root, "tmp/evil")))
+	names, err := filepath.Glob(filepath.Join(root, "d/*"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(root, "d/new")}, names)
+}
+
+func TestUnpackChecksDigest(t *testing.T) {
+	l := newLayout(t, "base", []entry{{name: "f", content: "f"}})
+	defer os.RemoveAll(string(l))
+	_, m, err := l.resolve("")
+	require.NoError(t, err)
+	p, err := l.blobPath(m.Layers[0].Digest)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(p, layerTar(t, []entry{{name: "f", content: "g"}}), 0644))
+
+	root, err := ioutil.TempDir("", "oci-root-")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	assert.Error(t, l.unpack(m, root))
+}
+
+func TestResolve(t *testing.T) {
+	l := newLayout(t, "base", []entry{{name: "f", content: "f"}})
+	defer os.RemoveAll(string(l))
+
+	_, _, err := l.resolve("missing")
+	assert.Error(t, err)
+	desc, _, err := l.resolve("base")
+	require.NoError(t, err)
+	require.NoError(t, l.tag("other", desc))
+	_, _, err = l.resolve("")
+	assert.Error(t, err, "Expected an error for an ambiguous image")
+	_, _, err = l.resolve("other")
+	assert.NoError(t, err)
+}
+
+func TestAddLayer(t *testing.T) {
+	l := newLayout(t, "base", []entry{
+		{name: "a/", typeflag: tar.TypeDir},
+		{name: "a/x", content: "x"},
+		{name: "keep", content: "keep"},
+	})
+	defer os.RemoveAll(string(l))
+	_, base, err := l.resolve("base")
+	require.NoError(t, err)
+
+	upper, err := ioutil.TempDir("", "oci-upper-")
+	require.NoError(t, err)
+	defer os.RemoveAll(upper)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(upper, "new"), []byte("new"), 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(upper, "a"), 0755))
+	// Whiteouts are character devices, which only root can create.
+	whiteouts := syscall.Mknod(filepath.Join(upper, "a/x"), syscall.S_IFCHR|0600, 0) == nil
+
+	require.NoError(t, l.addLayer(base, upper, "snap", "test"))
+	_, m, err := l.resolve("snap")
+	require.NoError(t, err)
+	assert.Equal(t, len(base.Layers)+1, len(m.Layers))
+	var config struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+		Config struct {
+			WorkingDir string
+		} `json:"config"`
+	}
+	require.NoError(t, l.readJSON(m.Config, &config))
+	assert.Equal(t, 1, len(config.RootFS.DiffIDs))
+	assert.Equal(t, "/src", config.Config.WorkingDir)
+
+	root, err := ioutil.TempDir("", "oci-root-")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	require.NoError(t, l.unpack(m, root))
+	assert.Equal(t, "new", readFile(t, filepath.Join(root, "new")))
+	assert.Equal(t, "keep", readFile(t, filepath.Join(root, "keep")))
+	if whiteouts {
+		_, err := os.Stat(filepath.Join(root, "a/x"))
+		assert.True(t, os.IsNotExist(err), "Expected a/x to be whited out")
+	}
+}
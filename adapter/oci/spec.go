@@ -0,0 +1,265 @@
+// +build linux
+
+package ociadapter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	autil "github.com/dropbox/changes-client/adapter"
+)
+
+// The parts of the OCI runtime spec (config.json) that commands need. See
+// https://github.com/opencontainers/runtime-spec/blob/master/config.md
+type spec struct {
+	OCIVersion string      `json:"ociVersion"`
+	Process    specProcess `json:"process"`
+	Root       specRoot    `json:"root"`
+	Hostname   string      `json:"hostname,omitempty"`
+	Mounts     []specMount `json:"mounts"`
+	Linux      specLinux   `json:"linux"`
+}
+
+type specProcess struct {
+	Terminal        bool             `json:"terminal"`
+	User            specUser         `json:"user"`
+	Args            []string         `json:"args"`
+	Env             []string         `json:"env"`
+	Cwd             string           `json:"cwd"`
+	Capabilities    specCapabilities `json:"capabilities"`
+	Rlimits         []specRlimit     `json:"rlimits"`
+	NoNewPrivileges bool             `json:"noNewPrivileges"`
+}
+
+type specUser struct {
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+}
+
+type specCapabilities struct {
+	Bounding  []string `json:"bounding"`
+	Effective []string `json:"effective"`
+	Permitted []string `json:"permitted"`
+}
+
+type specRlimit struct {
+	Type string `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+type specRoot struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly"`
+}
+
+type specMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Source      string   `json:"source"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type specLinux struct {
+	Resources     *specResources  `json:"resources,omitempty"`
+	Namespaces    []specNamespace `json:"namespaces"`
+	MaskedPaths   []string        `json:"maskedPaths"`
+	ReadonlyPaths []string        `json:"readonlyPaths"`
+}
+
+type specResources struct {
+	CPU    *specCPU    `json:"cpu,omitempty"`
+	Memory *specMemory `json:"memory,omitempty"`
+}
+
+type specCPU struct {
+	Quota  int64  `json:"quota"`
+	Period uint64 `json:"period"`
+}
+
+type specMemory struct {
+	Limit int64 `json:"limit"`
+}
+
+type specNamespace struct {
+	Type string `json:"type"`
+}
+
+// The capabilities Docker gives containers by default.
+var defaultCapabilities = []string{
+	"CAP_AUDIT_WRITE", "CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_FOWNER",
+	"CAP_FSETID", "CAP_KILL", "CAP_MKNOD", "CAP_NET_BIND_SERVICE",
+	"CAP_NET_RAW", "CAP_SETFCAP", "CAP_SETGID", "CAP_SETPCAP",
+	"CAP_SETUID", "CAP_SYS_CHROOT",
+}
+
+// newSpec returns the spec for running args in the root filesystem rootfs,
+// with at most cpus CPUs and memory MB of memory if they are nonzero.
+func newSpec(rootfs, hostname string, user specUser, args, env []string, cwd string,
+	mounts []*autil.BindMount, cpus, memory int) *spec {
+	s := &spec{
+		OCIVersion: "1.0.2",
+		Process: specProcess{
+			User: user,
+			Args: args,
+			Env:  env,
+			Cwd:  cwd,
+			Capabilities: specCapabilities{
+				Bounding:  defaultCapabilities,
+				Effective: defaultCapabilities,
+				Permitted: defaultCapabilities,
+			},
+			Rlimits:         []specRlimit{{Type: "RLIMIT_NOFILE", Hard: 1048576, Soft: 1048576}},
+			NoNewPrivileges: true,
+		},
+		Root:     specRoot{Path: rootfs},
+		Hostname: hostname,
+		Mounts: []specMount{
+			{Destination: "/proc", Type: "proc", Source: "proc"},
+			{Destination: "/dev", Type: "tmpfs", Source: "tmpfs",
+				Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+			{Destination: "/dev/pts", Type: "devpts", Source: "devpts",
+				Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"}},
+			{Destination: "/dev/shm", Type: "tmpfs", Source: "shm",
+				Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+			{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue",
+				Options: []string{"nosuid", "noexec", "nodev"}},
+			{Destination: "/sys", Type: "sysfs", Source: "sysfs",
+				Options: []string{"nosuid", "noexec", "nodev", "ro"}},
+		},
+		Linux: specLinux{
+			// Without a network namespace, commands use the host's network,
+			// as they can in LXC containers.
+			Namespaces: []specNamespace{{"pid"}, {"ipc"}, {"uts"}, {"mount"}},
+			MaskedPaths: []string{
+				"/proc/kcore", "/proc/latency_stats", "/proc/timer_list",
+				"/proc/timer_stats", "/proc/sched_debug", "/sys/firmware",
+			},
+			ReadonlyPaths: []string{
+				"/proc/asound", "/proc/bus", "/proc/fs", "/proc/irq",
+				"/proc/sys", "/proc/sysrq-trigger",
+			},
+		},
+	}
+	if _, err := os.Stat("/etc/resolv.conf"); err == nil {
+		s.Mounts = append(s.Mounts, specMount{Destination: "/etc/resolv.conf", Type: "bind",
+			Source: "/etc/resolv.conf", Options: []string{"bind", "ro"}})
+	}
+	for _, m := range mounts {
+		options := []string{"rbind"}
+		for _, o := range strings.Split(m.Options, ",") {
+			// create=dir and create=file are for LXC; runtimes create
+			// mount points anyway.
+			if o != "" && !strings.HasPrefix(o, "create=") {
+				options = append(options, o)
+			}
+		}
+		s.Mounts = append(s.Mounts, specMount{Destination: "/" + strings.Trim(m.Dest, "/"), Type: "bind",
+			Source: m.Source, Options: options})
+	}
+	if cpus != 0 || memory != 0 {
+		s.Linux.Resources = &specResources{}
+		if cpus != 0 {
+			// Up to cpus * 100ms of CPU time every 100ms.
+			s.Linux.Resources.CPU = &specCPU{Quota: int64(cpus) * 100000, Period: 100000}
+		}
+		if memory != 0 {
+			s.Linux.Resources.Memory = &specMemory{Limit: int64(memory) * 1024 * 1024}
+		}
+	}
+	return s
+}
+
+// mergeEnv returns base with the variables in overrides replacing those of
+// the same name, or added after them.
+func mergeEnv(base, overrides []string) []string {
+	index := make(map[string]int)
+	var res []string
+	for _, list := range [][]string{base, overrides} {
+		for _, e := range list {
+			name := strings.SplitN(e, "=", 2)[0]
+			if i, ok := index[name]; ok {
+				res[i] = e
+				continue
+			}
+			index[name] = len(res)
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// lookupUser returns the uid and gid for an image's user, which is of the
+// form user[:group], where each is a name or number. Names are looked up in
+// the image's /etc/passwd and /etc/group.
+func lookupUser(rootfs, user string) (specUser, error) {
+	var res specUser
+	if user == "" {
+		return res, nil
+	}
+	parts := strings.SplitN(user, ":", 2)
+	entry, err := lookupID(rootfs, "/etc/passwd", parts[0])
+	if err != nil {
+		return res, err
+	}
+	res.UID = entry.id
+	if len(parts) == 1 {
+		// The user's primary group.
+		res.GID = entry.gid
+		return res, nil
+	}
+	group, err := lookupID(rootfs, "/etc/group", parts[1])
+	if err != nil {
+		return res, err
+	}
+	res.GID = group.id
+	return res, nil
+}
+
+type idEntry struct {
+	id, gid uint32
+}
+
+// lookupID finds name, or a number, in an /etc/passwd or /etc/group format
+// file within rootfs.
+func lookupID(rootfs, file, name string) (idEntry, error) {
+	if n, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return idEntry{id: uint32(n)}, nil
+	}
+	p, err := secureJoin(rootfs, file)
+	if err != nil {
+		return idEntry{}, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return idEntry{}, fmt.Errorf("Failed to look up %s: %s", name, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// name:password:id[:gid...]
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		var entry idEntry
+		id, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return entry, fmt.Errorf("Malformed entry for %s in %s", name, file)
+		}
+		entry.id = uint32(id)
+		if len(fields) > 3 {
+			if gid, err := strconv.ParseUint(fields[3], 10, 32); err == nil {
+				entry.gid = uint32(gid)
+			}
+		}
+		return entry, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return idEntry{}, err
+	}
+	return idEntry{}, fmt.Errorf("%s not found in %s", name, file)
+}
@@ -0,0 +1,72 @@
+// +build linux
+
+package ociadapter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	autil "github.com/dropbox/changes-client/adapter"
+)
+
+func TestNewSpec(t *testing.T) {
+	mounts := []*autil.BindMount{{Source: "/cache/", Dest: "var/cache", Options: "ro,create=dir"}}
+	s := newSpec("/bundle/rootfs", "js-build", specUser{UID: 1000, GID: 1000},
+		[]string{"/script"}, []string{"A=b"}, "/src", mounts, 4, 8192)
+
+	assert.Equal(t, "/bundle/rootfs", s.Root.Path)
+	assert.Equal(t, []string{"/script"}, s.Process.Args)
+	assert.Equal(t, "/src", s.Process.Cwd)
+	assert.Equal(t, specUser{UID: 1000, GID: 1000}, s.Process.User)
+	last := s.Mounts[len(s.Mounts)-1]
+	assert.Equal(t, specMount{Destination: "/var/cache", Type: "bind", Source: "/cache/",
+		Options: []string{"rbind", "ro"}}, last)
+	require.NotNil(t, s.Linux.Resources)
+	assert.Equal(t, &specCPU{Quota: 400000, Period: 100000}, s.Linux.Resources.CPU)
+	assert.Equal(t, &specMemory{Limit: 8192 * 1024 * 1024}, s.Linux.Resources.Memory)
+	for _, ns := range s.Linux.Namespaces {
+		assert.NotEqual(t, "network", ns.Type)
+	}
+
+	s = newSpec("/rootfs", "", specUser{}, nil, nil, "/", nil, 0, 0)
+	assert.Nil(t, s.Linux.Resources)
+}
+
+func TestMergeEnv(t *testing.T) {
+	assert.Equal(t, []string{"PATH=/usr/bin", "HOME=/root", "A=b"},
+		mergeEnv([]string{"PATH=/bin", "HOME=/root"}, []string{"A=b", "PATH=/usr/bin"}))
+	assert.Equal(t, []string(nil), mergeEnv(nil, nil))
+}
+
+func TestLookupUser(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-root-")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	require.NoError(t, os.Mkdir(filepath.Join(root, "etc"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "etc/passwd"),
+		[]byte("root:x:0:0:root:/root:/bin/bash\nubuntu:x:1000:1001::/home/ubuntu:/bin/bash\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "etc/group"),
+		[]byte("root:x:0:\nwheel:x:10:ubuntu\n"), 0644))
+
+	cases := map[string]specUser{
+		"":             {},
+		"ubuntu":       {UID: 1000, GID: 1001},
+		"ubuntu:wheel": {UID: 1000, GID: 10},
+		"5":            {UID: 5},
+		"5:7":          {UID: 5, GID: 7},
+	}
+	for user, expected := range cases {
+		res, err := lookupUser(root, user)
+		assert.NoError(t, err, user)
+		assert.Equal(t, expected, res, user)
+	}
+	_, err = lookupUser(root, "nobody")
+	assert.Error(t, err)
+	_, err = lookupUser(root, "ubuntu:nogroup")
+	assert.Error(t, err)
+}
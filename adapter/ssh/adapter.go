@@ -0,0 +1,321 @@
+package sshadapter
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+
+	autil "github.com/dropbox/changes-client/adapter"
+	"github.com/dropbox/changes-client/client"
+	"github.com/dropbox/changes-client/client/adapter"
+	"github.com/dropbox/changes-client/common/glob"
+)
+
+// Adapter runs each command on a remote host over ssh, in a per-JobStep
+// workspace there. Artifacts are copied back to a local staging directory
+// before they are reported, so artifact root paths (including those of
+// FileExists conditions) refer to the staging directory rather than the
+// remote host.
+type Adapter struct {
+	config *client.Config
+	// The remote workspace, which relative command and artifact paths
+	// are relative to.
+	workspace string
+	// Remote directory holding command scripts and pid files, kept out of
+	// the workspace so that they can't be picked up as artifacts.
+	controlDir string
+	staging    string
+	runs       int32
+}
+
+func (a *Adapter) Init(config *client.Config) error {
+	if host == "" {
+		return errors.New("The ssh adapter requires --ssh-host")
+	}
+	staging, err := ioutil.TempDir("", "changes-client-artifacts-")
+	if err != nil {
+		return err
+	}
+	a.staging = staging
+	a.workspace = path.Join(remoteBase, config.JobstepID)
+	a.controlDir = a.workspace + ".client"
+	a.config = config
+	return nil
+}
+
+// sshArgs returns the ssh command line to run remoteCmd, a shell command, on
+// the remote host.
+func sshArgs(remoteCmd string) []string {
+	// Never prompt for passwords or host keys; there's nobody to answer.
+	res := []string{"ssh", "-o", "BatchMode=yes"}
+	if port != 0 {
+		res = append(res, "-p", strconv.Itoa(port))
+	}
+	if identity != "" {
+		res = append(res, "-i", identity)
+	}
+	for _, o := range strings.Split(sshOptions, ",") {
+		if o != "" {
+			res = append(res, "-o", o)
+		}
+	}
+	return append(res, host, remoteCmd)
+}
+
+// shellQuote quotes s as a single word for the remote shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// remotePath returns p as an absolute path on the remote host, where
+// relative paths are relative to the workspace.
+func (a *Adapter) remotePath(p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	return path.Join(a.workspace, p)
+}
+
+// remote runs remoteCmd on the remote host with the given stdin, returning
+// its stdout. Its stderr is included in any error.
+func remote(remoteCmd string, stdin io.Reader) ([]byte, error) {
+	args := sshArgs(remoteCmd)
+	c := exec.Command(args[0], args[1:]...)
+	c.Stdin = stdin
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		return out, fmt.Errorf("Failed to run %q on %s: %s: %s", remoteCmd, host, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// Prepare the environment for future commands. This is run before any
+// commands are processed and is run once.
+func (a *Adapter) Prepare(clientLog *client.Log) (client.Metrics, error) {
+	metrics := client.Metrics{}
+	clientLog.Printf("==> Creating workspace %s on %s", a.workspace, host)
+	out, err := remote(fmt.Sprintf("mkdir -p %s %s && uname -a",
+		shellQuote(a.workspace), shellQuote(a.controlDir)), nil)
+	if err != nil {
+		return metrics, err
+	}
+	clientLog.Printf("Remote host: %s", strings.TrimSpace(string(out)))
+	return metrics, nil
+}
+
+// runCommand returns the remote shell command to run script in cwd with env
+// added to the environment, recording the shell's pid in pidFile so that
+// its process group can be signalled.
+func runCommand(script, cwd, pidFile string, env []string) string {
+	// sshd runs the command in a new session, so the shell's pid is also
+	// its process group ID, and exec keeps it for the script.
+	res := fmt.Sprintf("echo $$ > %s && mkdir -p %s && cd %s && exec env",
+		shellQuote(pidFile), shellQuote(cwd), shellQuote(cwd))
+	for _, e := range env {
+		res += " " + shellQuote(e)
+	}
+	return res + " " + shellQuote(script)
+}
+
+// signal sends sig to the process group whose ID is recorded in pidFile.
+func signal(pidFile, sig string) {
+	cmd := fmt.Sprintf(`test -f %s && kill -s %s -- -"$(cat %s)" 2>/dev/null; true`,
+		shellQuote(pidFile), sig, shellQuote(pidFile))
+	if _, err := remote(cmd, nil); err != nil {
+		log.Printf("[ssh] %s", err)
+	}
+}
+
+// Run copies the command's script to the remote host and runs it over ssh
+// with the environment the build plan gives it, added to the remote login
+// environment rather than changes-client's, from its working directory
+// (relative to the remote workspace). As killing ssh leaves the remote command running,
+// a cancelled command's remote process group is signalled over another
+// connection before ssh itself is killed.
+func (a *Adapter) Run(ctx context.Context, cmd *client.Command, clientLog *client.Log) (*client.CommandResult, error) {
+	n := atomic.AddInt32(&a.runs, 1)
+	script := path.Join(a.controlDir, fmt.Sprintf("script-%d", n))
+	pidFile := path.Join(a.controlDir, fmt.Sprintf("pid-%d", n))
+
+	f, err := os.Open(cmd.Path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = remote(fmt.Sprintf("cat > %s && chmod 755 %s", shellQuote(script), shellQuote(script)), f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// Killing ssh doesn't kill the remote command, so when ctx is done the
+	// remote process group is signalled as CmdWrapper would signal a local
+	// one, and only then is ssh itself killed.
+	runCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exited := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			if cmd.KillGracePeriod > 0 {
+				clientLog.Printf("==> Sending SIGTERM; killing in %s if still running", cmd.KillGracePeriod)
+				signal(pidFile, "TERM")
+				select {
+				case <-time.After(cmd.KillGracePeriod):
+				case <-exited:
+				}
+			}
+			signal(pidFile, "KILL")
+			cancel()
+		case <-exited:
+		}
+	}()
+
+	cw := client.NewCmdWrapper(sshArgs(runCommand(script, a.remotePath(cmd.Cwd), pidFile, cmd.ConfigEnv)), "", nil)
+	cw.Stderr = cmd.Stderr
+	log.Printf("[ssh] Running %s on %s", script, host)
+	result, err := cw.RunContext(runCtx, cmd.CaptureOutput, clientLog)
+	close(exited)
+	wg.Wait()
+	return result, err
+}
+
+// Perform any cleanup actions within the environment.
+func (a *Adapter) Shutdown(clientLog *client.Log) (client.Metrics, error) {
+	if keepRemote {
+		clientLog.Printf("[ssh] Keeping workspace %s on %s", a.workspace, host)
+	} else if _, err := remote(fmt.Sprintf("rm -rf %s %s", shellQuote(a.workspace), shellQuote(a.controlDir)), nil); err != nil {
+		return nil, err
+	}
+	return nil, os.RemoveAll(a.staging)
+}
+
+func (a *Adapter) CaptureSnapshot(outputSnapshot string, clientLog *client.Log) error {
+	return errors.New("The ssh adapter does not support snapshots")
+}
+
+// GetRootFs returns the staging directory, as the remote host's filesystem
+// isn't available locally.
+func (a *Adapter) GetRootFs() string {
+	return a.staging
+}
+
+// CollectArtifacts copies the files under the artifact search path on the
+// remote host that match artifacts to the staging directory, and returns
+// the matches found there.
+func (a *Adapter) CollectArtifacts(artifacts []string, clientLog *client.Log) ([]string, error) {
+	source := a.remotePath(a.config.ArtifactSearchPath)
+	log.Printf("[ssh] Searching for %s in %s on %s", artifacts, source, host)
+	out, err := remote(fmt.Sprintf("cd %s && find . -type f -print0", shellQuote(source)), nil)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range strings.Split(string(out), "\x00") {
+		name = strings.TrimPrefix(name, "./")
+		if name == "" {
+			continue
+		}
+		if m, err := glob.MatchAny(artifacts, name); err != nil {
+			return nil, err
+		} else if m {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		clientLog.Printf("==> Copying %d artifacts from %s", len(names), host)
+		if err := a.pull(source, names); err != nil {
+			return nil, err
+		}
+	}
+	return autil.CollectArtifactsIn(a.staging, artifacts, clientLog)
+}
+
+// pull copies the named files, relative to the remote directory source, to
+// the staging directory.
+func (a *Adapter) pull(source string, names []string) error {
+	args := sshArgs(fmt.Sprintf("cd %s && tar -cf - --null -T -", shellQuote(source)))
+	c := exec.Command(args[0], args[1:]...)
+	c.Stdin = strings.NewReader(strings.Join(names, "\x00") + "\x00")
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := c.Start(); err != nil {
+		return err
+	}
+	extractErr := extract(tar.NewReader(stdout), a.staging)
+	// Let tar finish writing, or exit, if extraction failed early.
+	io.Copy(ioutil.Discard, stdout)
+	if err := c.Wait(); err != nil {
+		return fmt.Errorf("Failed to copy artifacts from %s: %s: %s", host, err, strings.TrimSpace(stderr.String()))
+	}
+	return extractErr
+}
+
+// extract writes the regular files in tr to dir, ignoring anything else.
+func extract(tr *tar.Reader, dir string) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("Refusing to extract %s outside of %s", hdr.Name, dir)
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, tr); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+	}
+}
+
+func (a *Adapter) GetArtifactRoot() string {
+	return a.staging
+}
+
+func New() adapter.Adapter {
+	return &Adapter{}
+}
+
+func init() {
+	adapter.Register("ssh", New)
+}
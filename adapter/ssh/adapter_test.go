@@ -0,0 +1,120 @@
+package sshadapter
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/dropbox/changes-client/client"
+)
+
+func TestSSHArgs(t *testing.T) {
+	host, port, identity, sshOptions = "build@remote", 0, "", ""
+	assert.Equal(t, []string{"ssh", "-o", "BatchMode=yes", "build@remote", "true"}, sshArgs("true"))
+
+	port, identity, sshOptions = 2222, "/keys/id", "StrictHostKeyChecking=no,,ConnectTimeout=5"
+	defer func() { port, identity, sshOptions = 0, "", "" }()
+	assert.Equal(t, []string{
+		"ssh", "-o", "BatchMode=yes", "-p", "2222", "-i", "/keys/id",
+		"-o", "StrictHostKeyChecking=no", "-o", "ConnectTimeout=5",
+		"build@remote", "true",
+	}, sshArgs("true"))
+}
+
+func TestRunCommand(t *testing.T) {
+	assert.Equal(t, `echo $$ > '/ws.client/pid-1' && mkdir -p '/ws/src' && cd '/ws/src' && exec env 'A=b c' 'Q='\''x'\''' '/ws.client/script-1'`,
+		runCommand("/ws.client/script-1", "/ws/src", "/ws.client/pid-1", []string{"A=b c", "Q='x'"}))
+
+	// The quoting must survive a real shell.
+	dir, err := ioutil.TempDir("", "ssh-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "script")
+	require.NoError(t, ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$A|$Q|$(pwd)\"\n"), 0755))
+	out, err := exec.Command("sh", "-c", runCommand(script, filepath.Join(dir, "a b"),
+		filepath.Join(dir, "pid"), []string{"A=b c", "Q='x'"})).Output()
+	require.NoError(t, err)
+	assert.Equal(t, "b c|'x'|"+filepath.Join(dir, "a b")+"\n", string(out))
+}
+
+func TestRunEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// Runs the remote command locally, in a login environment of its own.
+	bin := filepath.Join(dir, "bin")
+	require.NoError(t, os.Mkdir(bin, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(bin, "ssh"),
+		[]byte("#!/bin/sh\nfor last; do :; done\nexec env -i PATH=/usr/bin:/bin sh -c \"$last\"\n"), 0755))
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+	host, remoteBase = "build@remote", filepath.Join(dir, "remote")
+	defer func() { host, remoteBase = "", "/tmp/changes-client" }()
+
+	log := client.NewLog()
+	go log.Drain()
+	defer log.Close()
+	a := New().(*Adapter)
+	require.NoError(t, a.Init(&client.Config{JobstepID: "jobstep"}))
+	_, err = a.Prepare(log)
+	require.NoError(t, err)
+	defer a.Shutdown(log)
+
+	cmd, err := client.NewCommand("env", "#!/bin/sh\necho \"$FROM_CONFIG|$FROM_CLIENT\"\n")
+	require.NoError(t, err)
+	defer os.Remove(cmd.Path)
+	cmd.Env = []string{"FROM_CLIENT=1", "FROM_CONFIG=2"}
+	cmd.ConfigEnv = []string{"FROM_CONFIG=2"}
+	cmd.CaptureOutput = true
+	result, err := a.Run(context.Background(), cmd, log)
+	require.NoError(t, err)
+	// changes-client's own environment stays on this host.
+	assert.Equal(t, "2|\n", string(result.Output))
+}
+
+func TestRemotePath(t *testing.T) {
+	a := &Adapter{workspace: "/tmp/changes-client/js"}
+	assert.Equal(t, "/tmp/changes-client/js", a.remotePath(""))
+	assert.Equal(t, "/tmp/changes-client/js/src", a.remotePath("src/"))
+	assert.Equal(t, "/artifacts", a.remotePath("/artifacts/"))
+}
+
+func TestExtract(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "out/junit.xml", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		{Name: "link.xml", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+	} {
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Size > 0 {
+			_, err := tw.Write([]byte("test"))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+
+	dir, err := ioutil.TempDir("", "ssh-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, extract(tar.NewReader(&buf), dir))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "out/junit.xml"))
+	require.NoError(t, err)
+	assert.Equal(t, "test", string(data))
+	_, err = os.Lstat(filepath.Join(dir, "link.xml"))
+	assert.True(t, os.IsNotExist(err))
+
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "../escape", Typeflag: tar.TypeReg}))
+	require.NoError(t, tw.Close())
+	assert.Error(t, extract(tar.NewReader(&buf), dir))
+}
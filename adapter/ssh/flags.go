@@ -0,0 +1,23 @@
+package sshadapter
+
+import (
+	"flag"
+)
+
+var (
+	host       string
+	port       int
+	identity   string
+	sshOptions string
+	remoteBase string
+	keepRemote bool
+)
+
+func init() {
+	flag.StringVar(&host, "ssh-host", "", "Host to run commands on with the ssh adapter, as [user@]host")
+	flag.IntVar(&port, "ssh-port", 0, "Port of --ssh-host's ssh server, if not the default")
+	flag.StringVar(&identity, "ssh-identity", "", "Private key file to authenticate to --ssh-host with")
+	flag.StringVar(&sshOptions, "ssh-options", "", "Extra ssh options (as for -o). comma separated.")
+	flag.StringVar(&remoteBase, "ssh-dir", "/tmp/changes-client", "Directory on --ssh-host for the ssh adapter's per-JobStep workspaces")
+	flag.BoolVar(&keepRemote, "keep-remote", false, "Do not remove the ssh adapter's remote workspace on cleanup")
+}
@@ -1,6 +1,11 @@
 package adapter
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
 	"github.com/dropbox/changes-client/client"
 	"github.com/dropbox/changes-client/common/glob"
 )
@@ -16,3 +21,42 @@ func CollectArtifactsIn(dir string, artifacts []string, clientLog *client.Log) (
 	}
 	return matches, err
 }
+
+// MergeLimits returns the lower of the two resource limits, where zero or nil
+// means no limit.
+func MergeLimits(v int, other *int) int {
+	if other != nil {
+		if v == 0 || *other < v {
+			return *other
+		}
+	}
+	return v
+}
+
+// CopyFile copies src to dst, which ends up with the given mode even if it
+// already existed.
+func CopyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(dst, mode)
+}
+
+// OverlayOptions returns the mount options for an overlay of layers (topmost
+// first), with changes written to upper.
+func OverlayOptions(layers []string, upper, work string) string {
+	return fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(layers, ":"), upper, work)
+}
@@ -0,0 +1,42 @@
+package adapter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeLimits(t *testing.T) {
+	four, eight := 4, 8
+	assert.Equal(t, 0, MergeLimits(0, nil))
+	assert.Equal(t, 4, MergeLimits(4, nil))
+	assert.Equal(t, 8, MergeLimits(0, &eight))
+	assert.Equal(t, 4, MergeLimits(4, &eight))
+	assert.Equal(t, 4, MergeLimits(8, &four))
+}
+
+func TestCopyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "adapter-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	require.NoError(t, ioutil.WriteFile(src, []byte("script"), 0644))
+	require.NoError(t, ioutil.WriteFile(dst, []byte("previous contents"), 0600))
+
+	require.NoError(t, CopyFile(src, dst, 0755))
+	data, err := ioutil.ReadFile(dst)
+	require.NoError(t, err)
+	assert.Equal(t, "script", string(data))
+	info, err := os.Stat(dst)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode())
+}
+
+func TestOverlayOptions(t *testing.T) {
+	assert.Equal(t, "lowerdir=/snap:/base,upperdir=/s/upper,workdir=/s/work",
+		OverlayOptions([]string{"/snap", "/base"}, "/s/upper", "/s/work"))
+}
@@ -26,6 +26,7 @@ func main() {
 		exitResult  = flag.Bool("exit-result", false, "Determine exit code from result--exit 1 on any execution failure or 99 on any infrastructure failure")
 		showInfo    = flag.Bool("showinfo", false, "Prints basic information about this binary in a stable json format and exits.")
 		jobstepID   = flag.String("jobstep_id", "", "Jobstep ID whose commands are to be executed")
+		dryRun      = flag.Bool("dry-run", false, "Validate the build plan and print it without running anything")
 	)
 	flag.Parse()
 
@@ -49,11 +50,19 @@ func main() {
 		}
 	}
 
+	if *dryRun {
+		if err := runDry(*jobstepID); err != nil {
+			log.Printf("[client] dry run failed: %s", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	result := run(*jobstepID)
 	exitCode := 0
 	if *exitResult {
 		switch result {
-		case engine.RESULT_PASSED:
+		case engine.RESULT_PASSED, engine.RESULT_FLAKY:
 			exitCode = 0
 		case engine.RESULT_INFRA_FAILED:
 			// We use exit code 99 to signal to the generic-build script that
@@ -68,6 +77,15 @@ func main() {
 	os.Exit(exitCode)
 }
 
+// Loads the config and prints what running it would do.
+func runDry(jobstepID string) error {
+	config, err := client.GetConfig(jobstepID)
+	if err != nil {
+		return err
+	}
+	return engine.DryRun(config, os.Stdout)
+}
+
 // Returns whether run was successful.
 func run(jobstepID string) (result engine.Result) {
 	infraLog, err := filelog.New(jobstepID, "infralog")
@@ -3,6 +3,8 @@ package adapter
 import (
 	"fmt"
 
+	"golang.org/x/net/context"
+
 	"github.com/dropbox/changes-client/client"
 )
 
@@ -13,7 +15,9 @@ type Adapter interface {
 	// before any method other than Init is called. Any returned metrics
 	// will be reported via the active Reporter
 	Prepare(*client.Log) (client.Metrics, error)
-	Run(*client.Command, *client.Log) (*client.CommandResult, error)
+	// Run executes the command and waits for it to finish. If the context is
+	// done before then, the command and every process it started must be killed.
+	Run(context.Context, *client.Command, *client.Log) (*client.CommandResult, error)
 	Shutdown(*client.Log) (client.Metrics, error)
 	CaptureSnapshot(string, *client.Log) error
 	GetRootFs() string
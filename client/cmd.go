@@ -3,6 +3,8 @@ package client
 import (
 	"io/ioutil"
 	"os"
+	"syscall"
+	"time"
 )
 
 type Command struct {
@@ -11,11 +13,38 @@ type Command struct {
 	Env           []string
 	Cwd           string
 	CaptureOutput bool
+	// The entries of Env given by the build plan, without those passed
+	// through from changes-client's own environment, for adapters that
+	// run commands elsewhere.
+	ConfigEnv []string
+	// How long the command has to exit after SIGTERM when it is cancelled,
+	// before it is sent SIGKILL. If zero, it is sent SIGKILL right away.
+	KillGracePeriod time.Duration
+	// If set, the command's stderr is also written to this log, as well as
+	// being interleaved with its stdout in the log the command is run with.
+	Stderr *Log
 }
 
 type CommandResult struct {
 	Output  []byte // buffered output if requested
 	Success bool
+	// Exit status of the command, or -1 if it was killed by a signal.
+	ExitCode int
+	// The signal that killed the command, or 0 if it exited.
+	Signal   syscall.Signal
+	WallTime time.Duration
+	// Depending on the adapter, this may include CPU time used by other
+	// processes running alongside the command.
+	CPUTime time.Duration
+}
+
+// ReturnCode returns the code to report for the command, using the shell's
+// convention of 128 plus the signal number for commands killed by a signal.
+func (r *CommandResult) ReturnCode() int {
+	if r.Signal != 0 {
+		return 128 + int(r.Signal)
+	}
+	return r.ExitCode
 }
 
 // Build a new Command out of an arbitrary script
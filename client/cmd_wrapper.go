@@ -5,17 +5,28 @@ import (
 	"io"
 	"os/exec"
 	"sync"
+	"syscall"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 type CmdWrapper struct {
 	cmd *exec.Cmd
+	// How long to wait after SIGTERM before sending SIGKILL when
+	// RunContext's context is done. If zero, SIGKILL is sent right away.
+	KillGracePeriod time.Duration
+	// If set, stderr is also written to this log.
+	Stderr *Log
 }
 
 func NewCmdWrapper(command []string, cwd string, env []string) *CmdWrapper {
 	c := exec.Command(command[0], command[1:]...)
 	c.Env = env
 	c.Dir = cwd
+	// Run in a new process group so that the command and everything it
+	// spawns can be killed together.
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	return &CmdWrapper{
 		cmd: c,
 	}
@@ -35,12 +46,26 @@ func (cw *CmdWrapper) CombinedOutputPipe() (io.ReadCloser, io.WriteCloser) {
 }
 
 func (cw *CmdWrapper) Run(captureOutput bool, clientLog *Log) (*CommandResult, error) {
+	return cw.RunContext(context.Background(), captureOutput, clientLog)
+}
+
+// RunContext is like Run, but kills the command's entire process group
+// if ctx is done before the command exits. The group is sent SIGTERM first,
+// and SIGKILL once the command exits or KillGracePeriod has passed.
+func (cw *CmdWrapper) RunContext(ctx context.Context, captureOutput bool, clientLog *Log) (*CommandResult, error) {
 	stdin, err := cw.StdinPipe()
 	if err != nil {
 		return nil, err
 	}
 
 	cmdreader, cmdwriter := cw.CombinedOutputPipe()
+	var errreader io.ReadCloser
+	var errwriter io.WriteCloser
+	if cw.Stderr != nil {
+		// Still sent to the combined output too.
+		errreader, errwriter = io.Pipe()
+		cw.cmd.Stderr = io.MultiWriter(cmdwriter, errwriter)
+	}
 
 	clientLog.Printf("==> Executing %s", cw.cmd.Args)
 
@@ -53,6 +78,7 @@ func (cw *CmdWrapper) Run(captureOutput bool, clientLog *Log) (*CommandResult, e
 		reader = io.TeeReader(cmdreader, buffer)
 	}
 
+	start := time.Now()
 	err = cw.cmd.Start()
 
 	stdin.Close()
@@ -68,8 +94,37 @@ func (cw *CmdWrapper) Run(captureOutput bool, clientLog *Log) (*CommandResult, e
 		clientLog.WriteStream(reader)
 		wg.Done()
 	}()
+	if errreader != nil {
+		wg.Add(1)
+		go func() {
+			cw.Stderr.WriteStream(errreader)
+			wg.Done()
+		}()
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			// A negative pid signals every process in the group.
+			pgid := -cw.cmd.Process.Pid
+			if cw.KillGracePeriod > 0 {
+				clientLog.Printf("==> Sending SIGTERM; killing in %s if still running", cw.KillGracePeriod)
+				syscall.Kill(pgid, syscall.SIGTERM)
+				select {
+				case <-time.After(cw.KillGracePeriod):
+				case <-exited:
+				}
+			}
+			// Also clean up anything the command left behind when it exited.
+			syscall.Kill(pgid, syscall.SIGKILL)
+		case <-exited:
+		}
+	}()
 
 	err = cw.cmd.Wait()
+	wallTime := time.Since(start)
+	close(exited)
 
 	// Wait 10 seconds for the pipe to close. If it doesn't we give up on actually closing
 	// as a child process might be causing things to stick around.
@@ -78,6 +133,9 @@ func (cw *CmdWrapper) Run(captureOutput bool, clientLog *Log) (*CommandResult, e
 	sem := make(chan struct{}) // lol struct{} is cheaper than bool
 	go func() {
 		cmdwriter.Close()
+		if errwriter != nil {
+			errwriter.Close()
+		}
 		sem <- struct{}{}
 	}()
 
@@ -101,12 +159,20 @@ func (cw *CmdWrapper) Run(captureOutput bool, clientLog *Log) (*CommandResult, e
 		return nil, err
 	}
 
+	status := cw.cmd.ProcessState.Sys().(syscall.WaitStatus)
 	result := &CommandResult{
-		Success: cw.cmd.ProcessState.Success(),
+		Success:  cw.cmd.ProcessState.Success(),
+		ExitCode: status.ExitStatus(),
+		WallTime: wallTime,
+		// Includes any children the command waited for.
+		CPUTime: cw.cmd.ProcessState.UserTime() + cw.cmd.ProcessState.SystemTime(),
+	}
+	if status.Signaled() {
+		result.Signal = status.Signal()
 	}
 
 	if captureOutput {
-		result.Output = buffer.Bytes()
+		result.Output = Redact(buffer.Bytes())
 	} else {
 		result.Output = []byte("")
 	}
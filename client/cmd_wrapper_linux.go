@@ -0,0 +1,20 @@
+package client
+
+import (
+	"os"
+	"syscall"
+)
+
+// Isolate runs the command in new namespaces of the kinds given by
+// cloneflags (syscall.CLONE_NEWNS and so on), with the given user and group
+// ID mappings if a new user namespace is among them.
+func (cw *CmdWrapper) Isolate(cloneflags uintptr, uidMappings, gidMappings []syscall.SysProcIDMap) {
+	attr := cw.cmd.SysProcAttr
+	attr.Cloneflags = cloneflags
+	attr.UidMappings = uidMappings
+	attr.GidMappings = gidMappings
+	// Unprivileged processes can only write a group mapping once setgroups
+	// is denied in the namespace, which keeps sudo and su from working in
+	// it, so it is only denied if it has to be.
+	attr.GidMappingsEnableSetgroups = os.Geteuid() == 0
+}
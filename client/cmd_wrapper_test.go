@@ -2,7 +2,12 @@ package client
 
 import (
 	"bytes"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 func TestRun(t *testing.T) {
@@ -60,3 +65,160 @@ func TestRunFailToStart(t *testing.T) {
 		t.Fatal(err.Error())
 	}
 }
+
+func TestRunContextKillsProcessGroup(t *testing.T) {
+	// The backgrounded sleep keeps the output pipe open, so Run would not
+	// return promptly unless it is killed as well.
+	cw := NewCmdWrapper([]string{"/bin/bash", "-c", "sleep 60 & sleep 60"}, "", []string{})
+	log := NewLog()
+
+	sem := make(chan bool)
+	go func() {
+		log.Drain()
+		sem <- true
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result, err := cw.RunContext(ctx, false, log)
+	log.Close()
+	<-sem
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result.Success {
+		t.Error("Killed command reported success")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Took %s to kill command", elapsed)
+	}
+}
+
+func TestRunContextTerminatesGracefully(t *testing.T) {
+	cw := NewCmdWrapper([]string{"/bin/bash", "-c", "trap 'echo terminated; exit 3' TERM; sleep 60 & wait"}, "", []string{})
+	cw.KillGracePeriod = 5 * time.Second
+	log := NewLog()
+
+	var out []byte
+	sem := make(chan bool)
+	go func() {
+		for chunk, ok := log.GetChunk(); ok; chunk, ok = log.GetChunk() {
+			out = append(out, chunk...)
+		}
+		sem <- true
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result, err := cw.RunContext(ctx, false, log)
+	log.Close()
+	<-sem
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result.ExitCode != 3 {
+		t.Errorf("Expected exit code 3 from the TERM handler, got %d", result.ExitCode)
+	}
+	if !strings.Contains(string(out), "terminated") {
+		t.Errorf("TERM handler didn't run; output was %q", out)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("Took %s to terminate command", elapsed)
+	}
+}
+
+func TestRunContextKillsAfterGracePeriod(t *testing.T) {
+	cw := NewCmdWrapper([]string{"/bin/bash", "-c", "trap '' TERM; sleep 60"}, "", []string{})
+	cw.KillGracePeriod = 200 * time.Millisecond
+	log := NewLog()
+	go log.Drain()
+	defer log.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result, err := cw.RunContext(ctx, false, log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result.Success {
+		t.Error("Killed command reported success")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Took %s to kill command", elapsed)
+	}
+}
+
+func TestRunResultDetails(t *testing.T) {
+	cw := NewCmdWrapper([]string{"/bin/bash", "-c", "sleep 0.1; exit 7"}, "", []string{})
+	log := NewLog()
+	go log.Drain()
+	result, err := cw.Run(false, log)
+	log.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result.ExitCode != 7 || result.ReturnCode() != 7 {
+		t.Errorf("Expected exit code 7, got %d (return code %d)", result.ExitCode, result.ReturnCode())
+	}
+	if result.Signal != 0 {
+		t.Errorf("Expected no signal, got %s", result.Signal)
+	}
+	if result.WallTime < 100*time.Millisecond {
+		t.Errorf("Expected wall time of at least 100ms, got %s", result.WallTime)
+	}
+
+	cw = NewCmdWrapper([]string{"/bin/bash", "-c", "kill -TERM $$"}, "", []string{})
+	log = NewLog()
+	go log.Drain()
+	result, err = cw.Run(false, log)
+	log.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result.Signal != syscall.SIGTERM {
+		t.Errorf("Expected SIGTERM, got %s", result.Signal)
+	}
+	if result.ReturnCode() != 128+int(syscall.SIGTERM) {
+		t.Errorf("Expected return code %d, got %d", 128+int(syscall.SIGTERM), result.ReturnCode())
+	}
+}
+
+func TestRunSeparateStderr(t *testing.T) {
+	cw := NewCmdWrapper([]string{"/bin/bash", "-c", "echo out; echo err >&2"}, "", []string{})
+	log := NewLog()
+	cw.Stderr = NewLog()
+
+	collect := func(l *Log, dest *bytes.Buffer, done chan bool) {
+		for ch, ok := l.GetChunk(); ok; ch, ok = l.GetChunk() {
+			dest.Write(ch)
+		}
+		done <- true
+	}
+	var combined, stderr bytes.Buffer
+	sem := make(chan bool)
+	go collect(log, &combined, sem)
+	go collect(cw.Stderr, &stderr, sem)
+
+	result, err := cw.Run(true, log)
+	log.Close()
+	cw.Stderr.Close()
+	<-sem
+	<-sem
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if stderr.String() != "err\n" {
+		t.Errorf("Expected only stderr in the stderr log, got %q", stderr.String())
+	}
+	if !strings.Contains(combined.String(), "out\n") || !strings.Contains(combined.String(), "err\n") {
+		t.Errorf("Expected both streams in the combined log, got %q", combined.String())
+	}
+	// The two streams are copied separately, so their order isn't guaranteed.
+	if len(result.Output) != len("out\nerr\n") || !strings.Contains(string(result.Output), "err\n") {
+		t.Errorf("Expected both streams in the output, got %q", result.Output)
+	}
+}
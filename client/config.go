@@ -5,10 +5,13 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"os"
 	"strings"
 	"time"
+
+	"github.com/dropbox/changes-client/common/auth"
+	"github.com/dropbox/changes-client/common/retry"
 )
 
 var (
@@ -17,8 +20,12 @@ var (
 	upstreamMonitor    bool
 	debug              bool
 	ignoreSnapshots    bool
+	configFile         string
 )
 
+// The JobstepID used for builds run from a config file when none is given.
+const localJobstepID = "local"
+
 type ConfigCmd struct {
 	ID            string
 	Script        string
@@ -26,11 +33,105 @@ type ConfigCmd struct {
 	Cwd           string
 	Artifacts     []string
 	CaptureOutput bool
-	Type          struct {
+	// Maximum number of seconds the command may run before it is killed.
+	// Zero means no limit.
+	Timeout int
+	// Consecutive commands with the same non-empty Group are run concurrently.
+	Group string
+	Retry RetryPolicy
+	// Run this command even if an earlier command failed, timed out or was
+	// aborted, such as to stop services or collect diagnostics. The JobStep
+	// timeout doesn't apply to it, and its result never changes the JobStep's.
+	// Commands with type "teardown" are always run too.
+	AlwaysRun bool
+	// Maximum bytes of output to report; the rest is dropped, except for its
+	// tail. Zero means no limit.
+	LogLimit int64
+	// The command is skipped unless all of these are met.
+	Condition CommandCondition
+	Type      struct {
 		ID string
 	}
 }
 
+// CommandCondition describes when a command should run. Empty fields
+// always hold.
+type CommandCondition struct {
+	// Only run if an earlier command failed. Like always-run commands, these
+	// run after the failure, and their result never changes the JobStep's.
+	PreviousFailed bool
+	// Only run if this environment variable is set for the command.
+	EnvSet string
+	// Only run if this file exists. Relative paths are relative to the
+	// artifact search path; absolute paths are within the adapter's root
+	// filesystem.
+	FileExists string
+	// Only run when using the adapter with this name.
+	Adapter string
+}
+
+// IsAlwaysRun returns whether the command runs regardless of how the
+// commands before it went.
+func (c ConfigCmd) IsAlwaysRun() bool {
+	return c.AlwaysRun || c.Type.ID == "teardown"
+}
+
+// RunsAfterFailure returns whether the command may still run once an
+// earlier command has failed.
+func (c ConfigCmd) RunsAfterFailure() bool {
+	return c.IsAlwaysRun() || c.Condition.PreviousFailed
+}
+
+// GroupCommands splits cmds into runs of consecutive commands that share a
+// parallel group. Commands without a group always get a run of their own,
+// and commands that run after failures are never grouped with ones that don't.
+// Commands in runs of more than one are run concurrently, and their output is
+// only logged to their own sources rather than the console.
+func GroupCommands(cmds []ConfigCmd) [][]ConfigCmd {
+	var groups [][]ConfigCmd
+	for i, cmd := range cmds {
+		if i > 0 && cmd.Group != "" && cmd.Group == cmds[i-1].Group &&
+			cmd.RunsAfterFailure() == cmds[i-1].RunsAfterFailure() {
+			groups[len(groups)-1] = append(groups[len(groups)-1], cmd)
+		} else {
+			groups = append(groups, []ConfigCmd{cmd})
+		}
+	}
+	return groups
+}
+
+// RetryPolicy describes when a failed command should be run again,
+// for commands that are known to be flaky.
+type RetryPolicy struct {
+	// Maximum number of times to run the command, including the first.
+	// Commands are only run once if this is less than 2.
+	MaxAttempts int
+	// Seconds to wait before the second attempt; doubled for each attempt after that.
+	Backoff float64
+	// Exit codes that may be retried. If empty, any failure may be retried.
+	ExitCodes []int
+}
+
+// IsRetryable returns whether a command that failed with the given exit code
+// may be run again.
+func (r RetryPolicy) IsRetryable(exitCode int) bool {
+	if len(r.ExitCodes) == 0 {
+		return true
+	}
+	for _, c := range r.ExitCodes {
+		if c == exitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns how long to wait before running a command again after
+// the given (1-based) attempt failed.
+func (r RetryPolicy) Delay(attempt int) time.Duration {
+	return time.Duration(r.Backoff*float64(time.Second)) << uint(attempt-1)
+}
+
 // ResourceLimits describes all specified limits
 // that should be applied while executing the JobStep.
 type ResourceLimits struct {
@@ -74,6 +175,21 @@ type Config struct {
 
 	ResourceLimits ResourceLimits
 
+	// Maximum number of seconds all commands in the JobStep may take together.
+	// Zero means no limit.
+	Timeout int
+
+	// Maximum bytes of output to report from all commands together, as with
+	// a command's LogLimit. Zero means no limit.
+	LogLimit int64
+
+	// Masked in logs and captured command output, in addition to secrets.
+	Redact RedactConfig
+
+	// Path the config was read from, or "-" for stdin, if it was not fetched
+	// from the server. Never read from the config itself.
+	ConfigFile string `json:"-"`
+
 	DebugConfig map[string]*json.RawMessage `json:"debugConfig"`
 }
 
@@ -101,38 +217,33 @@ func (c *Config) GetDebugConfigBool(key string, fallback bool) bool {
 	return val
 }
 
-// Duration is in nanoseconds and is multiplied by 2 on each retry
+// fetchConfig retries requests that fail because of network errors or server
+// errors, as well as 404s.
 //
-// We need to retry because there is a race condition in interactions
+// We need to retry 404s because there is a race condition in interactions
 // with Changes where the jenkins job is created before the jobstep
 // in Changes. This probably only occurs when there is a long running
 // transaction. We don't want to delay too much, so we start with a small
 // delay in case the jenkins job just got started very quickly, but then we delay
 // longer between each retry in case we have to wait for some long transaction
 // to occur.
-//
-// NOTE: Due to the nature of this race condition we only retry on 404s.
-func fetchConfig(url string, retries int, retryDelay time.Duration) (*Config, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+func fetchConfig(httpClient *http.Client, url string, retrier *retry.Retrier) (*Config, error) {
+	var body []byte
+	err := retrier.Do("Fetching config", func(attempt int) error {
+		resp, err := httpClient.Get(url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		// The race condition ends up giving us a 404. If we got anything else, its
-		// a real error and we shouldn't bother retrying.
-		if retries == 0 || resp.StatusCode != 404 {
-			err := fmt.Errorf("Request to fetch config failed with status code: %d", resp.StatusCode)
-			return nil, err
-		} else {
-			log.Printf("Failed to fetch configuration (404). Retries left: %d", retries)
-			time.Sleep(retryDelay)
-			return fetchConfig(url, retries-1, retryDelay*2)
+		if resp.StatusCode != 200 {
+			return &retry.StatusError{Code: resp.StatusCode,
+				Message: fmt.Sprintf("Request to fetch config failed with status code: %d", resp.StatusCode)}
 		}
-	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+		body, err = ioutil.ReadAll(resp.Body)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -151,6 +262,10 @@ func LoadConfig(content []byte) (*Config, error) {
 }
 
 func GetConfig(jobstepID string) (*Config, error) {
+	if configFile != "" {
+		return getLocalConfig(configFile, jobstepID)
+	}
+
 	if server == "" {
 		return nil, fmt.Errorf("Missing required configuration: server")
 	}
@@ -161,8 +276,16 @@ func GetConfig(jobstepID string) (*Config, error) {
 
 	server = strings.TrimRight(server, "/")
 
+	httpClient, err := auth.NewClient(jobstepID)
+	if err != nil {
+		return nil, err
+	}
+
 	url := server + "/jobsteps/" + jobstepID + "/"
-	conf, err := fetchConfig(url, 8, 250*time.Millisecond)
+	policy := retry.DefaultPolicy()
+	// The race condition described in fetchConfig ends up giving us a 404.
+	policy.StatusCodes = append(policy.StatusCodes, 404)
+	conf, err := fetchConfig(httpClient, url, retry.New(policy, jobstepID))
 	if err != nil {
 		return nil, err
 	}
@@ -182,7 +305,44 @@ func GetConfig(jobstepID string) (*Config, error) {
 	return conf, nil
 }
 
+// getLocalConfig loads the config for a build that runs without a Changes
+// server, such as when reproducing a failed JobStep locally. path is the
+// file to read the JobStep JSON from, or "-" for stdin.
+func getLocalConfig(path string, jobstepID string) (*Config, error) {
+	var content []byte
+	var err error
+	if path == "-" {
+		content, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		content, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read config file: %s", err)
+	}
+
+	conf, err := LoadConfig(content)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse config file %s: %s", path, err)
+	}
+
+	if jobstepID == "" {
+		jobstepID = localJobstepID
+	}
+	conf.Server = strings.TrimRight(server, "/")
+	conf.JobstepID = jobstepID
+	conf.ArtifactSearchPath = artifactSearchPath
+	conf.ConfigFile = path
+	// There's nothing upstream to abort us.
+	conf.UpstreamMonitor = false
+
+	if ignoreSnapshots {
+		conf.Snapshot.ID = ""
+	}
+	return conf, nil
+}
+
 func init() {
+	flag.StringVar(&configFile, "config-file", "", "Read the JobStep config from this file (or stdin if \"-\") instead of fetching it from the server")
 	flag.StringVar(&server, "server", "", "URL to get config from")
 	flag.StringVar(&artifactSearchPath, "artifact-search-path", ".", "Folder where artifacts will be searched for relative to adapter root")
 	flag.BoolVar(&upstreamMonitor, "upstream-monitor", true, "Indicates whether the client should monitor upstream for aborts")
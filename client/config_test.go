@@ -2,10 +2,13 @@ package client
 
 import (
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -114,6 +117,65 @@ func TestGetConfig(t *testing.T) {
 	assert.Equal(t, envthing, Pair{"wat", 4})
 }
 
+func TestGetConfigRetriesServerErrors(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, jobStepResponse)
+	}))
+	defer ts.Close()
+
+	server = ts.URL
+	config, err := GetConfig("549db9a70d4d4d258e0a6d475ccd8a15")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, len(config.Cmds), 2)
+}
+
+func TestGetConfigFromFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "jobstep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = io.WriteString(f, jobStepResponse)
+	f.Close()
+	assert.NoError(t, err)
+
+	configFile = f.Name()
+	server = ""
+	upstreamMonitor = true
+	defer func() { configFile = "" }()
+
+	config, err := GetConfig("")
+	assert.NoError(t, err)
+
+	assert.Equal(t, config.ConfigFile, f.Name())
+	assert.Equal(t, config.JobstepID, localJobstepID)
+	assert.False(t, config.UpstreamMonitor)
+	assert.Equal(t, config.Server, "")
+	assert.Equal(t, len(config.Cmds), 2)
+	assert.Equal(t, config.Cmds[1].Script, "#!/bin/bash\necho test")
+
+	config, err = GetConfig("549db9a70d4d4d258e0a6d475ccd8a15")
+	assert.NoError(t, err)
+	assert.Equal(t, config.JobstepID, "549db9a70d4d4d258e0a6d475ccd8a15")
+
+	configFile = f.Name() + ".missing"
+	_, err = GetConfig("")
+	assert.Error(t, err)
+
+	// Only reading a config file sets its path, so that a config from the
+	// server can't make it look local.
+	config, err = LoadConfig([]byte(`{"ConfigFile": "-"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "", config.ConfigFile)
+}
+
 func TestParseResourceLimits(t *testing.T) {
 	ptrto := func(p int) *int {
 		return &p
@@ -214,3 +276,94 @@ func TestGetDebugConfigBool(t *testing.T) {
 		}
 	}
 }
+
+func TestRetryPolicy(t *testing.T) {
+	var none RetryPolicy
+	assert.True(t, none.IsRetryable(1))
+
+	p := RetryPolicy{MaxAttempts: 3, Backoff: 1.5, ExitCodes: []int{2, 3}}
+	assert.True(t, p.IsRetryable(3))
+	assert.False(t, p.IsRetryable(1))
+	assert.Equal(t, 1500*time.Millisecond, p.Delay(1))
+	assert.Equal(t, 3*time.Second, p.Delay(2))
+	assert.Equal(t, 6*time.Second, p.Delay(3))
+}
+
+func TestValidate(t *testing.T) {
+	config, err := LoadConfig([]byte(jobStepResponse))
+	assert.NoError(t, err)
+	assert.NoError(t, config.Validate())
+
+	config.Cmds = append(config.Cmds,
+		ConfigCmd{ID: "cmd_1", Script: "true"},
+		ConfigCmd{Script: "true", Cwd: "../elsewhere"},
+		ConfigCmd{ID: "bad", Env: map[string]string{"A=B": "c"}, Artifacts: []string{"*.xml", "["}, Timeout: -1},
+	)
+	zero := 0
+	config.ResourceLimits.Cpus = &zero
+	config.Snapshot.ID = "not-a-uuid"
+	config.Redact.Patterns = []string{`token=\w+`, "("}
+	config.LogLimit = -1
+	err = config.Validate()
+	if assert.Error(t, err) {
+		assert.Equal(t, ValidationErrors{
+			"logLimit: negative limit -1",
+			"resourceLimits.cpus: must be positive, not 0",
+			`snapshot.id: "not-a-uuid" is not a 32 digit hex UUID`,
+			"redact.patterns[1]: invalid regular expression: error parsing regexp: missing closing ): `(`",
+			"commands[2].id: duplicate id cmd_1",
+			"commands[3].id: required",
+			`commands[3].cwd: relative cwd "../elsewhere" leaves the working directory`,
+			"commands[4].script: required",
+			`commands[4].env: invalid variable name "A=B"`,
+			`commands[4].artifacts[1]: invalid pattern "[": syntax error in pattern`,
+			"commands[4].timeout: negative timeout -1",
+		}, err)
+	}
+
+	config, err = LoadConfig([]byte(`{"project": {"slug": "foo"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, ValidationErrors{"commands: required"}, config.Validate())
+}
+
+func TestWarnings(t *testing.T) {
+	config, err := LoadConfig([]byte(jobStepResponse))
+	assert.NoError(t, err)
+	assert.Empty(t, config.Warnings())
+
+	// Unknown command types are run anyway, as Changes may add new ones.
+	config.Cmds[1].Type.ID = "infra_stup"
+	assert.NoError(t, config.Validate())
+	assert.Equal(t, []string{`commands[1].type.id: unknown type "infra_stup"`}, config.Warnings())
+}
+
+func TestGroupCommandsAlwaysRun(t *testing.T) {
+	cmds := []ConfigCmd{
+		{ID: "a", Group: "g"},
+		{ID: "b", Group: "g", AlwaysRun: true},
+		{ID: "c", Group: "g", AlwaysRun: true},
+	}
+	groups := GroupCommands(cmds)
+	assert.Equal(t, [][]ConfigCmd{cmds[0:1], cmds[1:3]}, groups)
+}
+
+func TestGroupCommands(t *testing.T) {
+	cmds := []ConfigCmd{
+		{ID: "1"},
+		{ID: "2", Group: "a"},
+		{ID: "3", Group: "a"},
+		{ID: "4", Group: "b"},
+		{ID: "5"},
+		{ID: "6"},
+		{ID: "7", Group: "a"},
+	}
+	var ids [][]string
+	for _, group := range GroupCommands(cmds) {
+		var groupIds []string
+		for _, c := range group {
+			groupIds = append(groupIds, c.ID)
+		}
+		ids = append(ids, groupIds)
+	}
+	assert.Equal(t, [][]string{{"1"}, {"2", "3"}, {"4"}, {"5"}, {"6"}, {"7"}}, ids)
+}
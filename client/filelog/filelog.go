@@ -10,6 +10,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/dropbox/changes-client/client"
 	"github.com/dropbox/changes-client/client/reporter"
 	"github.com/dropbox/changes-client/common/sentry"
 )
@@ -61,9 +62,14 @@ func NewWithOptions(jobstepID, name string, flushDelay time.Duration, rootDir st
 	return f, nil
 }
 
-// Writes payload to temp file, which will eventually be sent to a reporter
+// Writes payload, with secrets masked, to temp file, which will eventually
+// be sent to a reporter
 func (f *FileLog) Write(p []byte) (int, error) {
-	return f.writeFile.Write(p)
+	if _, err := f.writeFile.Write(client.Redact(p)); err != nil {
+		return 0, err
+	}
+	// Masking may change the length, but callers expect to hear about theirs.
+	return len(p), nil
 }
 
 // Begins reporting the contents of the log (as it is appended to) to the
@@ -7,18 +7,46 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sync"
 	"time"
 )
 
 // After this many bytes are buffered, the buffered log data will be flushed.
 var byteFlushThreshold = flag.Int("log_chunk_size", 40960, "Size of log chunks to send to http server")
 
+// Up to this many bytes written to a log are buffered in memory until they
+// are read; anything more is spilled to disk.
+var bufferSizeThreshold = flag.Int("log_buffer_size", 8<<20, "Bytes of unreported log data to hold in memory before spilling to disk")
+
 // After this much time has elapsed, buffered log data will be flushed.
 const timeFlushThreshold = 4 * time.Second
 
+// Log collects output to be reported in chunks. Writes don't wait for the
+// chunks to be read with GetChunk: up to log_buffer_size bytes are buffered in
+// memory, and anything beyond that is spilled to disk until it is read, so
+// that commands are never held up by slow reporting.
 type Log struct {
-	chunkchan chan []byte
-	closed    chan struct{}
+	mu sync.Mutex
+	// Broadcast when a chunk is queued or read, or the log is closed.
+	cond   *sync.Cond
+	closed bool
+	// Chunks waiting to be read, oldest first, followed by any in spill.
+	queue []queuedChunk
+	// Bytes in queue.
+	queuedBytes int
+	spill       *spillFile
+	// Set if spilling failed, in which case writers wait for the reader instead.
+	spillFailed bool
+	stats       LogStats
+	// If set, limits the output written by WriteStream.
+	limiter *outputLimiter
+	// If set, chunks are also sent to this log.
+	tee *Log
+}
+
+type queuedChunk struct {
+	payload []byte
+	queued  time.Time
 }
 
 type LogLine struct {
@@ -27,29 +55,114 @@ type LogLine struct {
 }
 
 func NewLog() *Log {
-	return &Log{
-		chunkchan: make(chan []byte),
-		closed:    make(chan struct{}),
-	}
+	l := &Log{}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// NewTeeLog returns a new Log whose chunks are also sent to parent, such as to
+// report a command's output on its own as well as in the console.
+func NewTeeLog(parent *Log) *Log {
+	l := NewLog()
+	l.tee = parent
+	return l
 }
 
+// Close stops the log from accepting writes. Chunks already written can still
+// be read with GetChunk.
 func (l *Log) Close() {
-	close(l.closed)
+	l.mu.Lock()
+	limiter := l.limiter
+	l.mu.Unlock()
+	if limiter != nil {
+		if tail := limiter.finish(); len(tail) > 0 {
+			l.send(tail)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.cond.Broadcast()
 }
 
-// Sends the payload to the log, blocking until it is handled, and
-// returning an error only if it can't be (such as after
-// the log is closed).
+// Sends the payload to the log with secrets masked, returning an error only
+// if it can't be (such as after the log is closed).
 func (l *Log) write(payload []byte) error {
+	return l.send(Redact(payload))
+}
+
+// Like write, but for a payload that has already been masked.
+func (l *Log) send(payload []byte) error {
 	log.Print(string(payload))
-	select {
-	case <-l.closed:
-		// TODO: Too noisy?
-		log.Printf("WRITE AFTER CLOSE: %s", payload)
-		return errors.New("Write after close")
-	case l.chunkchan <- payload:
-		return nil
+	return l.deliver(payload)
+}
+
+// Queues the payload for GetChunk, and then for the tee, if any.
+func (l *Log) deliver(payload []byte) error {
+	l.mu.Lock()
+	err := l.enqueue(payload)
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if l.tee != nil {
+		// The payload made it to this log, so the tee closing isn't our problem.
+		l.tee.deliver(payload)
+	}
+	return nil
+}
+
+// Must be called with mu held.
+func (l *Log) enqueue(payload []byte) error {
+	for !l.closed {
+		now := time.Now()
+		spilling := l.spill != nil && l.spill.chunks > 0
+		if !spilling && (l.queuedBytes == 0 || l.queuedBytes+len(payload) <= *bufferSizeThreshold) {
+			l.queue = append(l.queue, queuedChunk{payload, now})
+			l.queuedBytes += len(payload)
+			l.stats.observeBuffered(l.bufferedBytes())
+			l.cond.Broadcast()
+			return nil
+		}
+		if !l.spillFailed {
+			err := l.spillChunk(payload, now)
+			if err == nil {
+				l.stats.SpilledBytes += int64(len(payload))
+				l.stats.observeBuffered(l.bufferedBytes())
+				l.cond.Broadcast()
+				return nil
+			}
+			log.Printf("Failed to spill log to disk; waiting for it to be reported instead: %s", err)
+			l.spillFailed = true
+		}
+		// Wait for the reader to make room.
+		l.cond.Wait()
 	}
+	// TODO: Too noisy?
+	log.Printf("WRITE AFTER CLOSE: %s", payload)
+	return errors.New("Write after close")
+}
+
+// Must be called with mu held.
+func (l *Log) spillChunk(payload []byte, queued time.Time) error {
+	if l.spill == nil {
+		spill, err := newSpillFile()
+		if err != nil {
+			return err
+		}
+		l.spill = spill
+	}
+	return l.spill.push(payload, queued)
+}
+
+// Bytes written but not yet read. Must be called with mu held.
+func (l *Log) bufferedBytes() int64 {
+	n := int64(l.queuedBytes)
+	if l.spill != nil {
+		n += l.spill.bytes
+	}
+	return n
 }
 
 // Writes the payload (with a newline appended) to the console, and
@@ -59,24 +172,62 @@ func (l *Log) Writeln(payload string) error {
 	return e
 }
 
-// Repeatedly calls GetChunk() until Close is called.
+// Repeatedly calls GetChunk() until the log is closed and everything
+// written to it has been read.
 // Mostly useful for tests.
 func (l *Log) Drain() {
 	for _, ok := l.GetChunk(); ok; _, ok = l.GetChunk() {
 	}
 }
 
-// Returns the next log chunk, or a nil slice and false if
-// Close was called.
+// Returns the next log chunk, waiting for one if necessary, or a nil slice
+// and false if Close was called and every chunk has been read.
 func (l *Log) GetChunk() ([]byte, bool) {
-	select {
-	case ch := <-l.chunkchan:
-		return ch, true
-	case <-l.closed:
-		return nil, false
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		var chunk queuedChunk
+		if len(l.queue) > 0 {
+			chunk = l.queue[0]
+			l.queue[0] = queuedChunk{}
+			l.queue = l.queue[1:]
+			l.queuedBytes -= len(chunk.payload)
+		} else if l.spill != nil && l.spill.chunks > 0 {
+			var err error
+			if chunk, err = l.spill.pop(); err != nil {
+				// Nothing sensible to do but skip what we can't read.
+				log.Printf("Failed to read spilled log: %s", err)
+				l.spill.reset()
+				l.cond.Broadcast()
+				continue
+			}
+		} else if l.closed {
+			if l.spill != nil {
+				l.spill.close()
+				l.spill = nil
+			}
+			return nil, false
+		} else {
+			l.cond.Wait()
+			continue
+		}
+		l.stats.observeLag(time.Since(chunk.queued))
+		l.cond.Broadcast()
+		return chunk.payload, true
 	}
 }
 
+// Stats returns statistics about how the log has been buffered so far.
+func (l *Log) Stats() LogStats {
+	l.mu.Lock()
+	stats, limiter := l.stats, l.limiter
+	l.mu.Unlock()
+	if limiter != nil {
+		stats.DroppedBytes = limiter.droppedBytes()
+	}
+	return stats
+}
+
 // Printf calls l.Writeln to print to the log. Arguments are handled in
 // the manner of fmt.Printf.
 // The output is guaranteed to be newline-terminated.
@@ -84,6 +235,9 @@ func (l *Log) Printf(format string, v ...interface{}) error {
 	return l.Writeln(fmt.Sprintf(format, v...))
 }
 
+// WriteStream sends everything read from pipe to the log, in chunks of
+// whole lines where possible, until it reaches EOF or an error.
+// Masked values that span chunks are masked too.
 func (l *Log) WriteStream(pipe io.Reader) {
 	lines := newLogLineReader(pipe)
 
@@ -120,20 +274,50 @@ func (l *Log) WriteStream(pipe io.Reader) {
 		}
 
 		if len(payload) > 0 {
-			l.write(payload)
+			// The line reader has already masked it.
+			l.sendOutput(payload)
 		}
 	}
 }
 
+// Longer lines are read in pieces of this size, so that a line without a
+// newline can't use unbounded memory.
+const maxLineFragment = 64 * 1024
+
+// newLogLineReader reads lines from pipe, masking them and timestamping them
+// if SetLogTimestamps says to. A line may be sent in more than one piece if
+// it is long, or if part of it has to be held back until it can be masked,
+// but it is only timestamped once.
 func newLogLineReader(pipe io.Reader) <-chan *LogLine {
-	r := bufio.NewReader(pipe)
+	r := bufio.NewReaderSize(pipe, maxLineFragment)
 	ch := make(chan *LogLine)
 
 	go func() {
+		var redactor redactStream
+		// Whether the next bytes read, and the next bytes sent, start a line.
+		readLineStart, sentLineStart := true, true
+		var lineTime time.Time
 		for {
-			line, err := r.ReadBytes('\n')
-			l := &LogLine{line: line, err: err}
-			ch <- l
+			if readLineStart {
+				// Timestamp lines when they start arriving, not when they end.
+				r.Peek(1)
+				lineTime = time.Now()
+			}
+			fragment, err := r.ReadSlice('\n')
+			if err == bufio.ErrBufferFull {
+				// The rest of the line will follow.
+				err = nil
+			}
+			if len(fragment) > 0 {
+				readLineStart = fragment[len(fragment)-1] == '\n'
+			}
+
+			line := redactor.redact(fragment)
+			if err != nil {
+				line = append(line, redactor.flush()...)
+			}
+			line, sentLineStart = stampLines(line, sentLineStart, lineTime)
+			ch <- &LogLine{line: line, err: err}
 
 			if err != nil {
 				return
@@ -100,3 +100,32 @@ func TestCloseUnblocks(t *testing.T) {
 	log.Close()
 	<-rendez
 }
+
+func TestTeeLog(t *testing.T) {
+	parent := NewLog()
+	child := NewTeeLog(parent)
+
+	parentChunks := make(chan string, 2)
+	go func() {
+		for ch, ok := parent.GetChunk(); ok; ch, ok = parent.GetChunk() {
+			parentChunks <- string(ch)
+		}
+	}()
+	go func() {
+		child.Printf("one")
+		child.Printf("two")
+		child.Close()
+	}()
+
+	var childOut string
+	for ch, ok := child.GetChunk(); ok; ch, ok = child.GetChunk() {
+		childOut += string(ch)
+	}
+	if childOut != "one\ntwo\n" {
+		t.Errorf("Expected child to get both lines, got %q", childOut)
+	}
+	if a, b := <-parentChunks, <-parentChunks; a+b != "one\ntwo\n" {
+		t.Errorf("Expected parent to get both lines, got %q", a+b)
+	}
+	parent.Close()
+}
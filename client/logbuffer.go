@@ -0,0 +1,124 @@
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// LogStats describes how much a Log had to buffer because its chunks weren't
+// read as fast as they were written, and how much output it dropped.
+type LogStats struct {
+	// Most bytes written but not yet read at any one time.
+	MaxBufferedBytes int64
+	// Longest a chunk waited between being written and being read.
+	MaxLag time.Duration
+	// Bytes that were buffered on disk rather than in memory.
+	SpilledBytes int64
+	// Bytes of output that were dropped because of an OutputLimit.
+	DroppedBytes int64
+}
+
+func (s *LogStats) observeBuffered(n int64) {
+	if n > s.MaxBufferedBytes {
+		s.MaxBufferedBytes = n
+	}
+}
+
+func (s *LogStats) observeLag(d time.Duration) {
+	if d > s.MaxLag {
+		s.MaxLag = d
+	}
+}
+
+// Add combines the stats of another log into s, as if they were one log
+// that buffered as much as the worst of the two.
+func (s *LogStats) Add(other LogStats) {
+	s.observeBuffered(other.MaxBufferedBytes)
+	s.observeLag(other.MaxLag)
+	s.SpilledBytes += other.SpilledBytes
+	s.DroppedBytes += other.DroppedBytes
+}
+
+// Metrics returns the stats as metrics to report.
+func (s LogStats) Metrics() Metrics {
+	m := Metrics{
+		"logMaxBufferedBytes": float64(s.MaxBufferedBytes),
+		"logSpilledBytes":     float64(s.SpilledBytes),
+		"logDroppedBytes":     float64(s.DroppedBytes),
+	}
+	m.SetDuration("logMaxLag", s.MaxLag)
+	return m
+}
+
+// Each chunk in a spill file is preceded by the time it was queued, in
+// nanoseconds since the epoch, and its length.
+const spillHeaderSize = 8 + 4
+
+// spillFile is a queue of log chunks on disk.
+type spillFile struct {
+	f *os.File
+	// Offsets of the next chunk to read and of the end of the last one written.
+	readOffset, writeOffset int64
+	// Number and total size of the chunks not yet read.
+	chunks int
+	bytes  int64
+}
+
+func newSpillFile() (*spillFile, error) {
+	f, err := ioutil.TempFile("", "changes-client-log-")
+	if err != nil {
+		return nil, err
+	}
+	// Nothing else needs the name, and this way the space is freed however we exit.
+	os.Remove(f.Name())
+	return &spillFile{f: f}, nil
+}
+
+func (s *spillFile) push(payload []byte, queued time.Time) error {
+	record := make([]byte, spillHeaderSize+len(payload))
+	binary.BigEndian.PutUint64(record, uint64(queued.UnixNano()))
+	binary.BigEndian.PutUint32(record[8:], uint32(len(payload)))
+	copy(record[spillHeaderSize:], payload)
+	if _, err := s.f.WriteAt(record, s.writeOffset); err != nil {
+		return err
+	}
+	s.writeOffset += int64(len(record))
+	s.chunks++
+	s.bytes += int64(len(payload))
+	return nil
+}
+
+// pop reads the oldest chunk not yet read. It must only be called if there
+// is one.
+func (s *spillFile) pop() (queuedChunk, error) {
+	var header [spillHeaderSize]byte
+	if _, err := s.f.ReadAt(header[:], s.readOffset); err != nil {
+		return queuedChunk{}, err
+	}
+	queued := time.Unix(0, int64(binary.BigEndian.Uint64(header[:])))
+	payload := make([]byte, binary.BigEndian.Uint32(header[8:]))
+	if _, err := s.f.ReadAt(payload, s.readOffset+spillHeaderSize); err != nil {
+		return queuedChunk{}, fmt.Errorf("reading %d byte chunk: %s", len(payload), err)
+	}
+	s.readOffset += spillHeaderSize + int64(len(payload))
+	s.chunks--
+	s.bytes -= int64(len(payload))
+	if s.chunks == 0 {
+		s.reset()
+	}
+	return queuedChunk{payload, queued}, nil
+}
+
+// reset discards everything in the file, to reuse the space.
+func (s *spillFile) reset() {
+	s.f.Truncate(0)
+	s.readOffset, s.writeOffset = 0, 0
+	s.chunks, s.bytes = 0, 0
+}
+
+func (s *spillFile) close() {
+	s.f.Close()
+}
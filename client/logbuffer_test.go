@@ -0,0 +1,72 @@
+package client
+
+import (
+	"flag"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogSpillsWithoutBlocking(t *testing.T) {
+	flag.Set("log_buffer_size", "10")
+	defer flag.Set("log_buffer_size", fmt.Sprint(8<<20))
+
+	log := NewLog()
+	var expected []string
+	// Nothing is reading, so this would block if writes weren't buffered.
+	for i := 0; i < 20; i++ {
+		line := fmt.Sprintf("line %d", i)
+		require.NoError(t, log.Writeln(line))
+		expected = append(expected, line+"\n")
+	}
+	log.Close()
+	assert.Error(t, log.Writeln("too late"))
+
+	var got []string
+	for chunk, ok := log.GetChunk(); ok; chunk, ok = log.GetChunk() {
+		got = append(got, string(chunk))
+	}
+	assert.Equal(t, expected, got)
+
+	stats := log.Stats()
+	assert.True(t, stats.SpilledBytes > 0)
+	assert.Equal(t, int64(len("line 0\n")*10+len("line 10\n")*10), stats.MaxBufferedBytes)
+	assert.True(t, stats.MaxLag > 0)
+}
+
+func TestSpillFile(t *testing.T) {
+	s, err := newSpillFile()
+	require.NoError(t, err)
+	defer s.close()
+
+	queued := time.Unix(1234, 5678)
+	require.NoError(t, s.push([]byte("first"), queued))
+	require.NoError(t, s.push([]byte(""), queued))
+	require.NoError(t, s.push([]byte("third"), queued))
+	assert.Equal(t, 3, s.chunks)
+	assert.Equal(t, int64(10), s.bytes)
+
+	for _, expected := range []string{"first", "", "third"} {
+		chunk, err := s.pop()
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(chunk.payload))
+		assert.True(t, queued.Equal(chunk.queued))
+	}
+	// Emptied, so the space is reused.
+	assert.Equal(t, int64(0), s.writeOffset)
+}
+
+func TestLogStatsAdd(t *testing.T) {
+	stats := LogStats{MaxBufferedBytes: 10, MaxLag: time.Second, SpilledBytes: 5}
+	stats.Add(LogStats{MaxBufferedBytes: 20, MaxLag: time.Millisecond, SpilledBytes: 7})
+	assert.Equal(t, LogStats{MaxBufferedBytes: 20, MaxLag: time.Second, SpilledBytes: 12}, stats)
+	assert.Equal(t, Metrics{
+		"logMaxBufferedBytes": 20,
+		"logMaxLag":           1,
+		"logSpilledBytes":     12,
+		"logDroppedBytes":     0,
+	}, stats.Metrics())
+}
@@ -0,0 +1,189 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// LogBudget is a number of bytes of output that may be shared by several logs,
+// such as all of those for a JobStep. It is safe for concurrent use.
+type LogBudget struct {
+	mu        sync.Mutex
+	remaining int64
+}
+
+func NewLogBudget(bytes int64) *LogBudget {
+	return &LogBudget{remaining: bytes}
+}
+
+// take uses up to n bytes of the budget, returning how many it could.
+// A nil budget has no limit.
+func (b *LogBudget) take(n int64) int64 {
+	if b == nil {
+		return n
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > b.remaining {
+		n = b.remaining
+	}
+	b.remaining -= n
+	return n
+}
+
+// OutputLimit limits how much of what WriteStream reads is sent on from a log.
+// Once either limit is reached, further output is dropped, except for its
+// tail, which is sent when the log is closed.
+type OutputLimit struct {
+	// Bytes of output to send. Zero means no limit.
+	Bytes int64
+	// Shared with other logs. May be nil.
+	Shared *LogBudget
+	// How many bytes at the end of the dropped output to send.
+	TailSize int
+	// If set, all output is written here too, dropped or not. It is closed
+	// along with the log.
+	Full io.WriteCloser
+}
+
+// Tracks how much of a log's output has been sent, under an OutputLimit.
+type outputLimiter struct {
+	limit OutputLimit
+	// Guards the fields below.
+	mu        sync.Mutex
+	sent      int64
+	truncated bool
+	dropped   int64
+	finished  bool
+	// The end of the dropped output, up to limit.TailSize bytes.
+	tail []byte
+}
+
+// LimitOutput applies limit to output written to the log from now on.
+// Messages written with Printf and Writeln are never dropped.
+func (l *Log) LimitOutput(limit OutputLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limiter = &outputLimiter{limit: limit}
+}
+
+// OutputTruncated returns whether any output has been dropped because of
+// the log's OutputLimit.
+func (l *Log) OutputTruncated() bool {
+	l.mu.Lock()
+	limiter := l.limiter
+	l.mu.Unlock()
+	if limiter == nil {
+		return false
+	}
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	return limiter.truncated
+}
+
+// Sends as much of a payload of (already masked) output as the log's limit
+// allows, followed by a notice if that's when the limit was reached.
+func (l *Log) sendOutput(payload []byte) error {
+	l.mu.Lock()
+	limiter := l.limiter
+	l.mu.Unlock()
+	if limiter == nil {
+		return l.send(payload)
+	}
+
+	allowed, notice := limiter.admit(payload)
+	if len(allowed) > 0 {
+		if err := l.send(allowed); err != nil {
+			return err
+		}
+	}
+	if notice != "" {
+		return l.write([]byte(notice))
+	}
+	return nil
+}
+
+func (lim *outputLimiter) droppedBytes() int64 {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	return lim.dropped
+}
+
+// admit records payload as output, returning the part of it that may be sent
+// and, if the limit was just reached, a notice saying so.
+func (lim *outputLimiter) admit(payload []byte) ([]byte, string) {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	if lim.limit.Full != nil && !lim.finished {
+		lim.limit.Full.Write(payload)
+	}
+	if lim.truncated {
+		lim.drop(payload)
+		return nil, ""
+	}
+
+	n := int64(len(payload))
+	if lim.limit.Bytes > 0 && lim.sent+n > lim.limit.Bytes {
+		n = lim.limit.Bytes - lim.sent
+	}
+	n = lim.limit.Shared.take(n)
+	lim.sent += n
+	if n == int64(len(payload)) {
+		return payload, ""
+	}
+
+	lim.truncated = true
+	lim.drop(payload[n:])
+	notice := fmt.Sprintf("\n==> Output limit reached after %d bytes; dropping the rest", lim.sent)
+	if lim.limit.TailSize > 0 {
+		notice += fmt.Sprintf(", except for the last %d bytes", lim.limit.TailSize)
+	}
+	return payload[:n], notice + "\n"
+}
+
+// Must be called with mu held.
+func (lim *outputLimiter) drop(payload []byte) {
+	lim.dropped += int64(len(payload))
+	if lim.limit.TailSize <= 0 {
+		return
+	}
+	lim.tail = append(lim.tail, payload...)
+	if excess := len(lim.tail) - lim.limit.TailSize; excess > 0 {
+		lim.tail = append(lim.tail[:0], lim.tail[excess:]...)
+	}
+}
+
+// finish returns what should be sent when the log is closed: a summary of
+// what was dropped and the tail of it, if anything was dropped. It closes
+// the Full writer.
+func (lim *outputLimiter) finish() []byte {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	if lim.finished {
+		return nil
+	}
+	lim.finished = true
+	if lim.limit.Full != nil {
+		lim.limit.Full.Close()
+	}
+	if !lim.truncated {
+		return nil
+	}
+	tail := lim.tail
+	// Start at a line, if we can.
+	if i := bytes.IndexByte(tail, '\n'); i >= 0 && i+1 < len(tail) && int64(len(tail)) < lim.dropped {
+		tail = tail[i+1:]
+	}
+	msg := []byte(fmt.Sprintf("==> Dropped %d bytes of output", lim.dropped))
+	if len(tail) == 0 {
+		return append(msg, '\n')
+	}
+	msg = append(msg, fmt.Sprintf("; the last %d follow:\n", len(tail))...)
+	msg = append(msg, tail...)
+	if msg[len(msg)-1] != '\n' {
+		msg = append(msg, '\n')
+	}
+	return msg
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestLimitOutput(t *testing.T) {
+	const in = "line1\nline2\nline3\nline4\n"
+	full := &closeRecorder{}
+	log := NewLog()
+	log.LimitOutput(OutputLimit{Bytes: 8, TailSize: 6, Full: full})
+	go func() {
+		log.Printf("==> Not counted")
+		log.WriteStream(strings.NewReader(in))
+		log.Close()
+	}()
+
+	var out []byte
+	for chunk, ok := log.GetChunk(); ok; chunk, ok = log.GetChunk() {
+		out = append(out, chunk...)
+	}
+	assert.Equal(t, "==> Not counted\n"+
+		"line1\nli\n==> Output limit reached after 8 bytes; dropping the rest, except for the last 6 bytes\n"+
+		"==> Dropped 16 bytes of output; the last 6 follow:\nline4\n", string(out))
+	assert.True(t, log.OutputTruncated())
+	assert.Equal(t, int64(16), log.Stats().DroppedBytes)
+	assert.Equal(t, in, full.String())
+	assert.True(t, full.closed)
+}
+
+func TestLimitOutputShared(t *testing.T) {
+	budget := NewLogBudget(5)
+	first, second := NewLog(), NewLog()
+	first.LimitOutput(OutputLimit{Shared: budget})
+	second.LimitOutput(OutputLimit{Shared: budget})
+
+	first.WriteStream(strings.NewReader("abc\n"))
+	second.WriteStream(strings.NewReader("defg\n"))
+	first.Close()
+	second.Close()
+
+	assert.False(t, first.OutputTruncated())
+	assert.True(t, second.OutputTruncated())
+	assert.Equal(t, int64(4), second.Stats().DroppedBytes)
+}
+
+func TestLimitOutputTailStartsAtLine(t *testing.T) {
+	lim := &outputLimiter{limit: OutputLimit{Bytes: 1, TailSize: 8}}
+	lim.admit([]byte("x"))
+	lim.admit([]byte("first\nsecond\n"))
+	assert.Equal(t, "==> Dropped 13 bytes of output; the last 7 follow:\nsecond\n", string(lim.finish()))
+	assert.Nil(t, lim.finish())
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// What masked values are replaced with.
+const redactedText = "****"
+
+// The most of an unterminated line that redactStream holds back for
+// patterns. Beyond this, output without newlines (such as progress bars
+// redrawn with \r) is masked and written as it comes; a match spanning the
+// cut can then be missed.
+const maxRedactLine = 64 * 1024
+
+var (
+	// Guards redactValues and redactPatterns.
+	redactMu sync.RWMutex
+	// Literal values to mask, such as resolved secrets.
+	redactValues [][]byte
+	// Masked wherever they match within a line.
+	redactPatterns []*regexp.Regexp
+)
+
+// RedactConfig lists what should be masked in logs and captured output.
+type RedactConfig struct {
+	Values []string
+	// Regular expressions, which are matched against one line at a time.
+	Patterns []string
+}
+
+// Apply registers everything in rc to be masked from now on.
+func (rc RedactConfig) Apply() error {
+	for _, v := range rc.Values {
+		AddRedaction(v)
+	}
+	for _, p := range rc.Patterns {
+		if err := AddRedactPattern(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddRedaction registers value to be masked in everything written to a Log
+// or the infra log, and in captured command output, from now on.
+func AddRedaction(value string) {
+	if value == "" {
+		return
+	}
+	redactMu.Lock()
+	defer redactMu.Unlock()
+	for _, v := range redactValues {
+		if string(v) == value {
+			return
+		}
+	}
+	redactValues = append(redactValues, []byte(value))
+}
+
+// AddRedactPattern registers a regular expression whose matches are masked
+// like values given to AddRedaction.
+func AddRedactPattern(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("Invalid redaction pattern %q: %s", pattern, err)
+	}
+	redactMu.Lock()
+	defer redactMu.Unlock()
+	redactPatterns = append(redactPatterns, re)
+	return nil
+}
+
+// Redact returns payload with everything registered for masking replaced.
+// payload is returned as is if there's nothing to mask in it.
+func Redact(payload []byte) []byte {
+	redactMu.RLock()
+	defer redactMu.RUnlock()
+	return redactMatches(redactLiterals(payload))
+}
+
+// Must be called with redactMu held.
+func redactLiterals(payload []byte) []byte {
+	for _, v := range redactValues {
+		if bytes.Contains(payload, v) {
+			payload = bytes.Replace(payload, v, []byte(redactedText), -1)
+		}
+	}
+	return payload
+}
+
+// Must be called with redactMu held.
+func redactMatches(payload []byte) []byte {
+	for _, re := range redactPatterns {
+		payload = re.ReplaceAllLiteral(payload, []byte(redactedText))
+	}
+	return payload
+}
+
+// redactStream masks a stream written in arbitrary pieces, holding back the
+// end of each piece if it could be the start of something to mask.
+type redactStream struct {
+	// Has had literals masked, but not patterns.
+	pending []byte
+}
+
+// redact returns what can be written of the stream so far, masked.
+func (s *redactStream) redact(p []byte) []byte {
+	redactMu.RLock()
+	defer redactMu.RUnlock()
+
+	buf := redactLiterals(append(s.pending, p...))
+	hold := 0
+	for _, v := range redactValues {
+		// The longest end of buf that a value starts with.
+		for n := min(len(v)-1, len(buf)); n > hold; n-- {
+			if bytes.HasSuffix(buf, v[:n]) {
+				hold = n
+				break
+			}
+		}
+	}
+	if len(redactPatterns) > 0 {
+		// Patterns only see whole lines.
+		if n := len(buf) - (bytes.LastIndexByte(buf, '\n') + 1); n > hold && n <= maxRedactLine {
+			hold = n
+		}
+	}
+	cut := len(buf) - hold
+	s.pending = append([]byte(nil), buf[cut:]...)
+	return redactMatches(buf[:cut])
+}
+
+// flush returns whatever redact held back, masked.
+func (s *redactStream) flush() []byte {
+	p := s.pending
+	s.pending = nil
+	return Redact(p)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -14,6 +14,8 @@ import (
 	"time"
 
 	"github.com/dropbox/changes-client/client"
+	"github.com/dropbox/changes-client/common/auth"
+	"github.com/dropbox/changes-client/common/retry"
 	"github.com/dropbox/changes-client/common/sentry"
 )
 
@@ -23,15 +25,11 @@ var (
 	// module) will become blocking.
 	maxPendingReports = 64
 
-	// Maximum number of times we retry a payload until we give up
-	// and panic.
-	//
-	// XXX the panic occurs during the publish goroutine, which might
-	// not be well characterized for properly handling the error.
+	// Maximum number of times we try to send a payload until we give up.
 	numPublishRetries = 8
 
-	// How long we wait before retrying a payload. We always wait
-	// this amount of time so the name here is a bit of a misnomer.
+	// How long we wait before retrying a payload for the first time.
+	// This doubles with each retry, up to the retry policy's limit.
 	backoffTimeMs = 1000
 )
 
@@ -53,6 +51,8 @@ type DefaultReporter struct {
 	jobstepID       string
 	publishUri      string
 	shutdownChannel chan struct{}
+	retrier         *retry.Retrier
+	httpClient      *http.Client
 }
 
 // All data that goes to the server is encompassed in a payload.
@@ -70,7 +70,7 @@ type ReportPayload struct {
 // as a MIME multipart (see RFC 2338).
 //
 // The file is also added a as field in the request body.
-func httpPost(uri string, params map[string]string, file string) (resp *http.Response, err error) {
+func httpPost(httpClient *http.Client, uri string, params map[string]string, file string) (resp *http.Response, err error) {
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
 
@@ -108,7 +108,7 @@ func httpPost(uri string, params map[string]string, file string) (resp *http.Res
 
 	_ = writer.Close()
 
-	resp, err = http.Post(uri, writer.FormDataContentType(), body)
+	resp, err = httpClient.Post(uri, writer.FormDataContentType(), body)
 
 	if err != nil {
 		return nil, err
@@ -128,57 +128,39 @@ func httpPost(uri string, params map[string]string, file string) (resp *http.Res
 // httpPost multiple times in order to account for flakiness in the
 // network connection. This function is synchronous.
 func (r *DefaultReporter) SendPayload(rp ReportPayload) error {
-	var (
-		resp   *http.Response
-		err    error
-		status string
-	)
-
 	path := r.publishUri + rp.Path
 	if rp.Data == nil {
 		rp.Data = make(map[string]string)
 	}
 
 	rp.Data["date"] = time.Now().UTC().Format("2006-01-02T15:04:05.0Z")
-	for tryCnt := 1; tryCnt <= numPublishRetries; tryCnt++ {
+	err := r.retrier.Do("POST "+path, func(tryCnt int) error {
 		log.Printf("[reporter] POST %s try: %d", path, tryCnt)
-		resp, err = httpPost(path, rp.Data, rp.Filename)
-
-		if resp != nil {
-			status = resp.Status
-		} else {
-			status = "-1"
+		resp, err := httpPost(r.httpClient, path, rp.Data, rp.Filename)
+		if err != nil {
+			return err
 		}
-
-		if resp != nil && resp.StatusCode/100 == 2 {
-			break
+		if resp.StatusCode/100 == 2 {
+			return nil
 		}
 
-		var errmsg string
-		if err != nil {
-			errmsg = err.Error()
-		} else {
-			// If there wasn't an IO error, use the response body as the error message.
-			var bodyData bytes.Buffer
-			if _, e := bodyData.ReadFrom(resp.Body); e != nil {
-				log.Printf("[reporter] Error reading POST %s response body: %s", path, e)
-			}
-			errmsg = bodyData.String()
-			if len(errmsg) > 140 {
-				// Keep it a reasonable length.
-				errmsg = errmsg[:137] + "..."
-			}
+		// If there wasn't an IO error, use the response body as the error message.
+		var bodyData bytes.Buffer
+		if _, e := bodyData.ReadFrom(resp.Body); e != nil {
+			log.Printf("[reporter] Error reading POST %s response body: %s", path, e)
 		}
-		log.Printf("[reporter] POST %s failed, try: %d, resp: %s, err: %s",
-			path, tryCnt, status, errmsg)
-
-		/* We are unable to publish to the endpoint.
-		 * Fail fast and let the above layers handle the outage */
-		if tryCnt == numPublishRetries {
-			return fmt.Errorf("reporter couldn't connect to publish endpoint %s; %s", path, errmsg)
+		errmsg := bodyData.String()
+		if len(errmsg) > 140 {
+			// Keep it a reasonable length.
+			errmsg = errmsg[:137] + "..."
 		}
-		log.Printf("[reporter] Sleep for %d ms", backoffTimeMs)
-		time.Sleep(time.Duration(backoffTimeMs) * time.Millisecond)
+		return &retry.StatusError{Code: resp.StatusCode, Message: resp.Status + ": " + errmsg}
+	})
+
+	/* We are unable to publish to the endpoint.
+	 * Fail fast and let the above layers handle the outage */
+	if err != nil {
+		return fmt.Errorf("reporter couldn't connect to publish endpoint %s; %s", path, err)
 	}
 	return nil
 }
@@ -200,6 +182,18 @@ func (r *DefaultReporter) Init(c *client.Config) {
 	r.publishUri = c.Server
 	r.shutdownChannel = make(chan struct{})
 	r.jobstepID = c.JobstepID
+	policy := retry.DefaultPolicy()
+	policy.MaxAttempts = numPublishRetries
+	policy.InitialDelay = time.Duration(backoffTimeMs) * time.Millisecond
+	r.retrier = retry.New(policy, c.JobstepID)
+	if httpClient, err := auth.NewClient(c.JobstepID); err != nil {
+		// Carry on; Changes will tell us if it needed the credentials.
+		log.Printf("[reporter] Failed to set up authentication: %s", err)
+		sentry.Error(err, map[string]string{})
+		r.httpClient = &http.Client{}
+	} else {
+		r.httpClient = httpClient
+	}
 	r.PublishChannel = make(chan ReportPayload, maxPendingReports)
 	// Initialize the goroutine that actually sends the requests.
 	go transportSend(r)
@@ -243,5 +237,5 @@ func init() {
 	flag.IntVar(&numPublishRetries, "num_publish_retries", 8,
 		"Number of times to retry")
 	flag.IntVar(&backoffTimeMs, "backoff_time_ms", 1000,
-		"Time to wait between two consecutive retries")
+		"Time to wait before the first retry")
 }
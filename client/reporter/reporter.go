@@ -34,8 +34,13 @@ type Reporter interface {
 	// be noted that if no other machinery provides this functionality
 	// (as is the case for Mesos builds) then these are absolutely required
 	// as without them Changes will never receive updates.
-	PushCommandStatus(cID string, status string, retCode int)
-	PushCommandOutput(cID string, status string, retCode int, output []byte)
+	//
+	// attempt is the 1-based number of the attempt being reported, as commands
+	// with a retry policy may be run more than once. result is how the command's
+	// process finished, if it ran to completion; it is nil otherwise, such as
+	// for commands that are still in progress or could not be started.
+	PushCommandStatus(cID string, status string, retCode int, attempt int, result *client.CommandResult)
+	PushCommandOutput(cID string, status string, retCode int, attempt int, result *client.CommandResult, output []byte)
 	PushJobstepStatus(status string, result string)
 	// returns false if pushing the log chunk failed
 	PushLogChunk(source string, payload []byte) bool
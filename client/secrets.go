@@ -0,0 +1,93 @@
+package client
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Env values of this form are replaced with the named secret.
+const secretPrefix = "secret://"
+
+var (
+	secretsDir  string
+	secretsFile string
+)
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ResolveSecret returns the value of the named secret, from the secrets
+// directory if one was given, and otherwise the secrets file.
+func ResolveSecret(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "/\x00") || name == "." || name == ".." {
+		return "", fmt.Errorf("Invalid secret name %q", name)
+	}
+	if secretsDir != "" {
+		data, err := ioutil.ReadFile(filepath.Join(secretsDir, name))
+		if err != nil {
+			return "", fmt.Errorf("Failed to read secret %s: %s", name, err)
+		}
+		return strings.TrimRight(string(data), "\n"), nil
+	}
+	if secretsFile != "" {
+		data, err := ioutil.ReadFile(secretsFile)
+		if err != nil {
+			return "", fmt.Errorf("Failed to read secrets file: %s", err)
+		}
+		var secrets map[string]string
+		if err := json.Unmarshal(data, &secrets); err != nil {
+			return "", fmt.Errorf("Malformed secrets file %s: %s", secretsFile, err)
+		}
+		if v, ok := secrets[name]; ok {
+			return v, nil
+		}
+		return "", fmt.Errorf("Secret %s not found in %s", name, secretsFile)
+	}
+	return "", fmt.Errorf("Secret %s referenced, but no secrets directory or file was given", name)
+}
+
+// ExpandEnv returns env with "secret://name" values replaced by the named
+// secret and "${VAR}" references within other values replaced by the value of
+// VAR from env itself (as given, without expansion, but with any secret
+// resolved) or else from lookup. Unknown variables expand to nothing, like in
+// the shell. Resolved secrets are registered with AddRedaction.
+func ExpandEnv(env map[string]string, lookup func(string) (string, bool)) (map[string]string, error) {
+	resolved := make(map[string]string, len(env))
+	for k, v := range env {
+		if strings.HasPrefix(v, secretPrefix) {
+			secret, err := ResolveSecret(strings.TrimPrefix(v, secretPrefix))
+			if err != nil {
+				return nil, err
+			}
+			AddRedaction(secret)
+			v = secret
+		}
+		resolved[k] = v
+	}
+
+	res := make(map[string]string, len(env))
+	for k, v := range env {
+		if strings.HasPrefix(v, secretPrefix) {
+			res[k] = resolved[k]
+			continue
+		}
+		res[k] = envReference.ReplaceAllStringFunc(v, func(ref string) string {
+			name := envReference.FindStringSubmatch(ref)[1]
+			if val, ok := resolved[name]; ok {
+				return val
+			}
+			val, _ := lookup(name)
+			return val
+		})
+	}
+	return res, nil
+}
+
+func init() {
+	flag.StringVar(&secretsDir, "secrets-dir", "", "Directory with a file per secret, for resolving secret:// env values")
+	flag.StringVar(&secretsFile, "secrets-file", "", "JSON file mapping secret names to values, for resolving secret:// env values")
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandEnv(t *testing.T) {
+	lookup := func(name string) (string, bool) {
+		if name == "HOME" {
+			return "/home/changes", true
+		}
+		return "", false
+	}
+	env, err := ExpandEnv(map[string]string{
+		"PLAIN":   "value",
+		"HOST":    "${HOME}/bin",
+		"LOCAL":   "${PLAIN}-${PLAIN}",
+		"UNKNOWN": "[${NOPE}]",
+		"SHELL":   "$HOME stays",
+	}, lookup)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"PLAIN":   "value",
+		"HOST":    "/home/changes/bin",
+		"LOCAL":   "value-value",
+		"UNKNOWN": "[]",
+		"SHELL":   "$HOME stays",
+	}, env)
+}
+
+func TestExpandEnvSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "token"), []byte("s3cr3t-from-dir\n"), 0600))
+
+	secretsDir = dir
+	defer func() { secretsDir = "" }()
+
+	env, err := ExpandEnv(map[string]string{"TOKEN": "secret://token", "FOO": "${TOKEN}"}, os.LookupEnv)
+	require.NoError(t, err)
+	assert.Equal(t, "s3cr3t-from-dir", env["TOKEN"])
+	// References get the secret, not the reference to it.
+	assert.Equal(t, "s3cr3t-from-dir", env["FOO"])
+	assert.Equal(t, "token=****\n", string(Redact([]byte("token=s3cr3t-from-dir\n"))))
+
+	_, err = ExpandEnv(map[string]string{"TOKEN": "secret://missing"}, os.LookupEnv)
+	assert.Error(t, err)
+	_, err = ExpandEnv(map[string]string{"TOKEN": "secret://../token"}, os.LookupEnv)
+	assert.Error(t, err)
+}
+
+func TestResolveSecretFromFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "secrets_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`{"db": "hunter2-from-file"}`)
+	f.Close()
+
+	secretsFile = f.Name()
+	defer func() { secretsFile = "" }()
+
+	v, err := ResolveSecret("db")
+	require.NoError(t, err)
+	assert.Equal(t, "hunter2-from-file", v)
+	_, err = ResolveSecret("other")
+	assert.Error(t, err)
+}
+
+func TestLogRedactsSecrets(t *testing.T) {
+	AddRedaction("very-secret-log-value")
+	log := NewLog()
+	go func() {
+		log.Printf("password is very-secret-log-value")
+		log.Close()
+	}()
+
+	var out []byte
+	for chunk, ok := log.GetChunk(); ok; chunk, ok = log.GetChunk() {
+		out = append(out, chunk...)
+	}
+	assert.Equal(t, "password is ****\n", string(out))
+}
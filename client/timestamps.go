@@ -0,0 +1,81 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How lines read by WriteStream may be timestamped.
+const (
+	TimestampsNone      = ""
+	TimestampsElapsed   = "elapsed"
+	TimestampsWallClock = "wallclock"
+)
+
+var (
+	// Guards timestampMode and timestampStart.
+	timestampMu    sync.RWMutex
+	timestampMode  string
+	timestampStart time.Time
+)
+
+// SetLogTimestamps sets whether lines read by WriteStream are prefixed with
+// the time they started arriving: either the wall-clock time, or the time
+// elapsed since SetLogTimestamps was called.
+func SetLogTimestamps(mode string) error {
+	switch mode {
+	case TimestampsNone, TimestampsElapsed, TimestampsWallClock:
+	default:
+		return fmt.Errorf("Unknown log timestamp mode %q", mode)
+	}
+	timestampMu.Lock()
+	defer timestampMu.Unlock()
+	timestampMode = mode
+	timestampStart = time.Now()
+	return nil
+}
+
+// Returns the prefix for a line that started arriving at t, or nil if lines
+// aren't timestamped.
+func timestampPrefix(t time.Time) []byte {
+	timestampMu.RLock()
+	defer timestampMu.RUnlock()
+	switch timestampMode {
+	case TimestampsElapsed:
+		d := t.Sub(timestampStart)
+		return []byte(fmt.Sprintf("[%02d:%02d:%02d.%03d] ",
+			int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60, int(d/time.Millisecond)%1000))
+	case TimestampsWallClock:
+		return []byte(t.UTC().Format("[2006-01-02 15:04:05.000] "))
+	}
+	return nil
+}
+
+// stampLines prefixes every line that starts in p with the timestamp for t.
+// atStart is whether p starts a line, and the returned bool is whether
+// whatever follows p does.
+func stampLines(p []byte, atStart bool, t time.Time) ([]byte, bool) {
+	if len(p) == 0 {
+		return p, atStart
+	}
+	prefix := timestampPrefix(t)
+	if prefix == nil {
+		return p, p[len(p)-1] == '\n'
+	}
+	var out []byte
+	for len(p) > 0 {
+		if atStart {
+			out = append(out, prefix...)
+		}
+		end := bytes.IndexByte(p, '\n') + 1
+		if end == 0 {
+			end = len(p)
+		}
+		out = append(out, p[:end]...)
+		atStart = p[end-1] == '\n'
+		p = p[end:]
+	}
+	return out, atStart
+}
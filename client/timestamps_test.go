@@ -0,0 +1,50 @@
+package client
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStampLines(t *testing.T) {
+	require.NoError(t, SetLogTimestamps(TimestampsWallClock))
+	defer SetLogTimestamps(TimestampsNone)
+	at := time.Date(2016, 3, 4, 5, 6, 7, 8e6, time.UTC)
+
+	out, atStart := stampLines([]byte("one\ntwo\nthr"), true, at)
+	assert.Equal(t, "[2016-03-04 05:06:07.008] one\n[2016-03-04 05:06:07.008] two\n[2016-03-04 05:06:07.008] thr", string(out))
+	assert.False(t, atStart)
+
+	// The rest of a partial line isn't stamped again.
+	out, atStart = stampLines([]byte("ee\n"), atStart, at)
+	assert.Equal(t, "ee\n", string(out))
+	assert.True(t, atStart)
+}
+
+func TestSetLogTimestampsUnknown(t *testing.T) {
+	assert.Error(t, SetLogTimestamps("sundial"))
+}
+
+func TestWriteStreamTimestamps(t *testing.T) {
+	require.NoError(t, SetLogTimestamps(TimestampsElapsed))
+	defer SetLogTimestamps(TimestampsNone)
+
+	// Longer than a fragment, and without a trailing newline.
+	long := strings.Repeat("x", maxLineFragment+10)
+	log := NewLog()
+	go func() {
+		log.WriteStream(bytes.NewReader([]byte("short\n" + long)))
+		log.Close()
+	}()
+
+	var out []byte
+	for chunk, ok := log.GetChunk(); ok; chunk, ok = log.GetChunk() {
+		out = append(out, chunk...)
+	}
+	assert.Regexp(t, `^\[00:00:00\.\d{3}\] short\n\[00:00:00\.\d{3}\] x+$`, string(out))
+	assert.Equal(t, 2, strings.Count(string(out), "[00:00:00."))
+}
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dropbox/changes-client/common/glob"
+)
+
+// Command types that Changes generates. Others are run like default commands,
+// as newer versions of Changes may add types, but are warned about in case
+// they're typos.
+var knownCommandTypes = map[string]bool{
+	"":              true,
+	"default":       true,
+	"collect_jobs":  true,
+	"collect_tests": true,
+	"setup":         true,
+	"teardown":      true,
+	"infra_setup":   true,
+}
+
+// ValidationErrors lists the problems found in a Config, each prefixed with
+// the path of the field it concerns, such as "commands[2].cwd".
+type ValidationErrors []string
+
+func (v ValidationErrors) Error() string {
+	return "Invalid config: " + strings.Join(v, "; ")
+}
+
+func (v *ValidationErrors) addf(path string, format string, args ...interface{}) {
+	*v = append(*v, path+": "+fmt.Sprintf(format, args...))
+}
+
+// Validate checks the config for problems that would keep it from running
+// as intended, such as missing or malformed commands, returning
+// ValidationErrors listing all of them if there are any.
+func (c *Config) Validate() error {
+	var errs ValidationErrors
+	if c.Cmds == nil {
+		errs.addf("commands", "required")
+	}
+	if c.Timeout < 0 {
+		errs.addf("timeout", "negative timeout %d", c.Timeout)
+	}
+	if c.LogLimit < 0 {
+		errs.addf("logLimit", "negative limit %d", c.LogLimit)
+	}
+	if c.ResourceLimits.Cpus != nil && *c.ResourceLimits.Cpus <= 0 {
+		errs.addf("resourceLimits.cpus", "must be positive, not %d", *c.ResourceLimits.Cpus)
+	}
+	if c.ResourceLimits.Memory != nil && *c.ResourceLimits.Memory <= 0 {
+		errs.addf("resourceLimits.memory", "must be positive, not %d", *c.ResourceLimits.Memory)
+	}
+	validateSnapshotID(&errs, "snapshot.id", c.Snapshot.ID)
+	validateSnapshotID(&errs, "expectedSnapshot.id", c.ExpectedSnapshot.ID)
+	for i, p := range c.Redact.Patterns {
+		if _, err := regexp.Compile(p); err != nil {
+			errs.addf(fmt.Sprintf("redact.patterns[%d]", i), "invalid regular expression: %s", err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, cmd := range c.Cmds {
+		path := fmt.Sprintf("commands[%d]", i)
+		if cmd.ID != "" && seen[cmd.ID] {
+			errs.addf(path+".id", "duplicate id %s", cmd.ID)
+		}
+		seen[cmd.ID] = true
+		cmd.validate(&errs, path)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Warnings lists things in the config that don't keep it from running but
+// may not be what was intended, each prefixed with the path of the field it
+// concerns, like ValidationErrors.
+func (c *Config) Warnings() []string {
+	var warnings []string
+	for i, cmd := range c.Cmds {
+		if !knownCommandTypes[cmd.Type.ID] {
+			warnings = append(warnings, fmt.Sprintf("commands[%d].type.id: unknown type %q", i, cmd.Type.ID))
+		}
+	}
+	return warnings
+}
+
+// Snapshot IDs are UUIDs without dashes, as adapter.FormatUUID expects.
+func validateSnapshotID(errs *ValidationErrors, path string, id string) {
+	if id == "" {
+		return
+	}
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		errs.addf(path, "%q is not a 32 digit hex UUID", id)
+	}
+}
+
+// validate adds everything wrong with the command that would keep it from
+// running as intended to errs, using path as the command's field path.
+func (c ConfigCmd) validate(errs *ValidationErrors, path string) {
+	if c.ID == "" {
+		errs.addf(path+".id", "required")
+	}
+	if c.Script == "" {
+		errs.addf(path+".script", "required")
+	}
+	if strings.ContainsRune(c.Cwd, 0) {
+		errs.addf(path+".cwd", "%q contains a NUL byte", c.Cwd)
+	} else if !filepath.IsAbs(c.Cwd) && strings.HasPrefix(filepath.Clean(c.Cwd), "..") {
+		errs.addf(path+".cwd", "relative cwd %q leaves the working directory", c.Cwd)
+	}
+	var envNames []string
+	for k := range c.Env {
+		envNames = append(envNames, k)
+	}
+	sort.Strings(envNames)
+	for _, k := range envNames {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			errs.addf(path+".env", "invalid variable name %q", k)
+		} else if strings.ContainsRune(c.Env[k], 0) {
+			errs.addf(path+".env."+k, "contains a NUL byte")
+		}
+	}
+	for i, a := range c.Artifacts {
+		if err := glob.ValidatePattern(a); err != nil {
+			errs.addf(fmt.Sprintf("%s.artifacts[%d]", path, i), "invalid pattern %q: %s", a, err)
+		}
+	}
+	if c.Timeout < 0 {
+		errs.addf(path+".timeout", "negative timeout %d", c.Timeout)
+	}
+	if c.LogLimit < 0 {
+		errs.addf(path+".logLimit", "negative limit %d", c.LogLimit)
+	}
+	if c.Retry.MaxAttempts < 0 {
+		errs.addf(path+".retry.maxAttempts", "negative attempts %d", c.Retry.MaxAttempts)
+	}
+	if c.Retry.Backoff < 0 {
+		errs.addf(path+".retry.backoff", "negative backoff %v", c.Retry.Backoff)
+	}
+}
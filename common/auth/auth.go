@@ -0,0 +1,202 @@
+// Package auth adds credentials to requests to the Changes API.
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	tokenFile      string
+	tokenEnv       string
+	hmacKeyFile    string
+	clientCertFile string
+	clientKeyFile  string
+	caCertFile     string
+)
+
+// Headers set on requests signed with an HMAC key.
+const (
+	JobstepHeader   = "X-Changes-Jobstep"
+	TimestampHeader = "X-Changes-Timestamp"
+	SignatureHeader = "X-Changes-Signature"
+)
+
+// An Authenticator adds credentials to a request before it is sent.
+type Authenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+// BearerToken authenticates requests with an OAuth-style bearer token.
+type BearerToken string
+
+func (t BearerToken) Authenticate(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+string(t))
+	return nil
+}
+
+// HMACSigner signs requests with a key shared with Changes, so that Changes
+// can verify which JobStep a request came from.
+type HMACSigner struct {
+	Key       []byte
+	JobstepID string
+}
+
+func (s *HMACSigner) Authenticate(req *http.Request) error {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(JobstepHeader, s.JobstepID)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, s.Signature(req.Method, req.URL.Path, timestamp, body))
+	return nil
+}
+
+// Signature returns the hex-encoded HMAC-SHA256 of the request's method,
+// path, timestamp, JobStep and the SHA-256 of its body, each on its own line.
+func (s *HMACSigner) Signature(method, path, timestamp string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, s.Key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, path, timestamp, s.JobstepID, hex.EncodeToString(bodyHash[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// transport applies authenticators to every request before sending it.
+type transport struct {
+	base           http.RoundTripper
+	authenticators []Authenticator
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request they're given.
+	authReq := new(http.Request)
+	*authReq = *req
+	authReq.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		authReq.Header[k] = append([]string(nil), v...)
+	}
+	for _, a := range t.authenticators {
+		if err := a.Authenticate(authReq); err != nil {
+			return nil, err
+		}
+	}
+	return t.base.RoundTrip(authReq)
+}
+
+// Authenticators returns the Authenticators configured by flags for
+// requests made on behalf of the given JobStep.
+func Authenticators(jobstepID string) ([]Authenticator, error) {
+	var res []Authenticator
+	var token string
+	if tokenFile != "" {
+		data, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read auth token: %s", err)
+		}
+		token = strings.TrimSpace(string(data))
+	} else if tokenEnv != "" {
+		token = os.Getenv(tokenEnv)
+		if token == "" {
+			return nil, fmt.Errorf("Auth token environment variable %s is not set", tokenEnv)
+		}
+	}
+	if token != "" {
+		res = append(res, BearerToken(token))
+	}
+
+	if hmacKeyFile != "" {
+		key, err := ioutil.ReadFile(hmacKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read HMAC key: %s", err)
+		}
+		res = append(res, &HMACSigner{Key: bytes.TrimSpace(key), JobstepID: jobstepID})
+	}
+	return res, nil
+}
+
+// tlsConfig returns the TLS configuration set by flags, or nil if the
+// defaults should be used.
+func tlsConfig() (*tls.Config, error) {
+	if clientCertFile == "" && caCertFile == "" {
+		return nil, nil
+	}
+	conf := &tls.Config{}
+	if clientCertFile != "" {
+		keyFile := clientKeyFile
+		if keyFile == "" {
+			// The key may be in the same PEM file as the certificate.
+			keyFile = clientCertFile
+		}
+		cert, err := tls.LoadX509KeyPair(clientCertFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %s", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if caCertFile != "" {
+		pem, err := ioutil.ReadFile(caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA certificate: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", caCertFile)
+		}
+		conf.RootCAs = pool
+	}
+	return conf, nil
+}
+
+// NewClient returns an http.Client for requests to Changes made on behalf of
+// the given JobStep, using the credentials configured by flags.
+func NewClient(jobstepID string) (*http.Client, error) {
+	authenticators, err := Authenticators(jobstepID)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf, err := tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if len(authenticators) == 0 && tlsConf == nil {
+		return &http.Client{}, nil
+	}
+
+	var base http.RoundTripper = http.DefaultTransport
+	if tlsConf != nil {
+		base = &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConf,
+			TLSHandshakeTimeout: 10 * time.Second,
+		}
+	}
+	return &http.Client{Transport: &transport{base: base, authenticators: authenticators}}, nil
+}
+
+func init() {
+	flag.StringVar(&tokenFile, "auth-token-file", "", "File containing a bearer token to send to Changes")
+	flag.StringVar(&tokenEnv, "auth-token-env", "", "Environment variable containing a bearer token to send to Changes, if -auth-token-file isn't set")
+	flag.StringVar(&hmacKeyFile, "auth-hmac-key-file", "", "File containing a key to sign requests to Changes with")
+	flag.StringVar(&clientCertFile, "auth-client-cert", "", "PEM client certificate to present to Changes")
+	flag.StringVar(&clientKeyFile, "auth-client-key", "", "PEM key for -auth-client-cert, if it isn't in the same file")
+	flag.StringVar(&caCertFile, "auth-ca-cert", "", "PEM CA certificate to verify Changes with, instead of the system's")
+}
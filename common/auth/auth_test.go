@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func writeTemp(t *testing.T, content []byte) string {
+	f, err := ioutil.TempFile("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestBearerToken(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization")
+	}))
+	defer ts.Close()
+
+	tokenFile = writeTemp(t, []byte("s3cret\n"))
+	defer os.Remove(tokenFile)
+	defer func() { tokenFile = "" }()
+
+	c, err := NewClient("jobstep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got != "Bearer s3cret" {
+		t.Errorf("Expected bearer token, got Authorization %q", got)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Error("Original request was modified")
+	}
+}
+
+func TestMissingTokenEnv(t *testing.T) {
+	tokenEnv = "CHANGES_CLIENT_TEST_UNSET_TOKEN"
+	defer func() { tokenEnv = "" }()
+	if _, err := NewClient("jobstep"); err == nil {
+		t.Error("Expected an error for an unset token variable")
+	}
+}
+
+func TestHMACSigner(t *testing.T) {
+	signer := &HMACSigner{Key: []byte("key"), JobstepID: "jobstep"}
+	var verified bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		expected := signer.Signature(r.Method, r.URL.Path, r.Header.Get(TimestampHeader), body)
+		verified = string(body) == "payload" &&
+			r.Header.Get(JobstepHeader) == "jobstep" &&
+			r.Header.Get(SignatureHeader) == expected
+	}))
+	defer ts.Close()
+
+	hmacKeyFile = writeTemp(t, []byte("key\n"))
+	defer os.Remove(hmacKeyFile)
+	defer func() { hmacKeyFile = "" }()
+
+	c, err := NewClient("jobstep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Post(ts.URL+"/jobsteps/jobstep/", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !verified {
+		t.Error("Request signature didn't verify")
+	}
+	if signer.Signature("GET", "/", "1", nil) == signer.Signature("POST", "/", "1", nil) {
+		t.Error("Signature doesn't depend on the method")
+	}
+}
+
+func TestCACert(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	c, err := NewClient("jobstep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ts.URL); err == nil {
+		t.Fatal("Expected an unknown CA to be rejected")
+	}
+
+	caCertFile = writeTemp(t, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}))
+	defer os.Remove(caCertFile)
+	defer func() { caCertFile = "" }()
+
+	c, err = NewClient("jobstep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
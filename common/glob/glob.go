@@ -13,6 +13,13 @@ import (
 	"github.com/dropbox/changes-client/common/sentry"
 )
 
+// ValidatePattern returns an error if pattern is not a valid pattern
+// for GlobTreeRegular.
+func ValidatePattern(pattern string) error {
+	_, err := filepath.Match(strings.TrimPrefix(pattern, "/"), "")
+	return err
+}
+
 // GlobTreeRegular walks root looking for regular (non-dir, non-device) files
 // that match the provided glob patterns and returns them in matches.
 // If a pattern contains a /, it is matched against the path relative to root
@@ -28,20 +35,12 @@ func GlobTreeRegular(root string, patterns []string) (matches []string, skipped
 			// log to sentry but continue walking the tree
 			return nil
 		}
-		basename := filepath.Base(path)
 		relpath, err := filepath.Rel(root, path)
 		if err != nil {
 			return err
 		}
 		for _, pattern := range patterns {
-			strToMatch := basename
-			if strings.Contains(pattern, "/") {
-				if strings.HasPrefix(pattern, "/") {
-					pattern = pattern[1:]
-				}
-				strToMatch = relpath
-			}
-			if m, e := filepath.Match(pattern, strToMatch); e != nil {
+			if m, e := matchPattern(pattern, relpath); e != nil {
 				return e
 			} else if m {
 				if f == nil || !f.Mode().IsRegular() {
@@ -57,3 +56,24 @@ func GlobTreeRegular(root string, patterns []string) (matches []string, skipped
 	err = filepath.Walk(root, visit)
 	return matches, skipped, err
 }
+
+// matchPattern reports whether relpath matches pattern in the way
+// GlobTreeRegular matches files.
+func matchPattern(pattern, relpath string) (bool, error) {
+	if strings.Contains(pattern, "/") {
+		return filepath.Match(strings.TrimPrefix(pattern, "/"), relpath)
+	}
+	return filepath.Match(pattern, filepath.Base(relpath))
+}
+
+// MatchAny reports whether relpath, a path relative to the root of a tree,
+// matches any of patterns in the way GlobTreeRegular matches files. It is
+// for trees that can't be walked locally.
+func MatchAny(patterns []string, relpath string) (bool, error) {
+	for _, pattern := range patterns {
+		if m, err := matchPattern(pattern, relpath); err != nil || m {
+			return m, err
+		}
+	}
+	return false, nil
+}
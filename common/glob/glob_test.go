@@ -96,3 +96,39 @@ func contains(l []string, s string) bool {
 	}
 	return false
 }
+
+func TestValidatePattern(t *testing.T) {
+	for _, p := range []string{"*.xml", "/foo/*/bar.txt", "junit-[0-9].xml"} {
+		if e := ValidatePattern(p); e != nil {
+			t.Errorf("Expected %q to be valid, got %s", p, e)
+		}
+	}
+	for _, p := range []string{"[", "foo/[a-", "\\"} {
+		if e := ValidatePattern(p); e == nil {
+			t.Errorf("Expected %q to be invalid", p)
+		}
+	}
+}
+
+func TestMatchAny(t *testing.T) {
+	patterns := []string{"*.xml", "/tests.json", "foo/*/weird.json"}
+	cases := map[string]bool{
+		"base.xml":               true,
+		"foo/test.xml":           true,
+		"tests.json":             true,
+		"foo/tests.json":         false,
+		"foo/bar/weird.json":     true,
+		"foo/bar/baz/weird.json": false,
+		"bar/foo/weird.json":     false,
+	}
+	for relpath, expected := range cases {
+		if m, e := MatchAny(patterns, relpath); e != nil {
+			t.Errorf("MatchAny(%q) failed: %s", relpath, e)
+		} else if m != expected {
+			t.Errorf("MatchAny(%q) = %v, expected %v", relpath, m, expected)
+		}
+	}
+	if _, e := MatchAny([]string{"["}, "a"); e == nil {
+		t.Error("Expected an error for a malformed pattern")
+	}
+}
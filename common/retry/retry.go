@@ -0,0 +1,172 @@
+// Package retry retries operations that may fail transiently, such as
+// requests to Changes.
+package retry
+
+import (
+	"flag"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	maxElapsedFlag time.Duration
+	maxDelayFlag   time.Duration
+	jitterFlag     float64
+)
+
+// Policy describes how an operation is retried. The delay between attempts
+// starts at InitialDelay and doubles after every attempt, up to MaxDelay.
+type Policy struct {
+	// Maximum number of attempts, including the first. Zero means no limit.
+	MaxAttempts  int
+	InitialDelay time.Duration
+	// Zero means no limit.
+	MaxDelay time.Duration
+	// Give up rather than wait past this long after the first attempt.
+	// Zero means no limit.
+	MaxElapsed time.Duration
+	// Fraction of each delay, from 0 to 1, by which it is randomly varied so
+	// that many clients that failed at once don't all retry at once.
+	Jitter float64
+	// HTTP status classes (5 for 5xx and so on) and individual status codes
+	// that are worth retrying. Requests that fail with other statuses aren't.
+	StatusClasses []int
+	StatusCodes   []int
+}
+
+// DefaultPolicy returns the policy to use for requests to Changes, as
+// configured by flags.
+func DefaultPolicy() Policy {
+	return Policy{
+		InitialDelay:  250 * time.Millisecond,
+		MaxDelay:      maxDelayFlag,
+		MaxElapsed:    maxElapsedFlag,
+		Jitter:        jitterFlag,
+		StatusClasses: []int{5},
+		// Request timeout and rate limiting.
+		StatusCodes: []int{408, 429},
+	}
+}
+
+// RetryableStatus returns whether a request that failed with the given
+// HTTP status code should be retried.
+func (p Policy) RetryableStatus(code int) bool {
+	for _, c := range p.StatusClasses {
+		if code/100 == c {
+			return true
+		}
+	}
+	for _, c := range p.StatusCodes {
+		if code == c {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusError is an error for a request that failed with an HTTP status code.
+// It is retried only if the policy allows it.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
+type permanentError struct {
+	error
+}
+
+// Permanent wraps err so that it is returned without being retried.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// NewRand returns a random number generator seeded with seed, typically the
+// JobStep ID, so that different JobSteps vary their timing differently. It
+// is independent of other users of math/rand.
+func NewRand(seed string) *rand.Rand {
+	h := fnv.New64()
+	h.Write([]byte(seed))
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// Retrier runs operations, retrying them according to its Policy.
+// It is safe for concurrent use.
+type Retrier struct {
+	policy Policy
+	// Guards rand.
+	mu    sync.Mutex
+	rand  *rand.Rand
+	sleep func(time.Duration)
+}
+
+// New returns a Retrier for p, with jitter seeded by seed as in NewRand.
+func New(p Policy, seed string) *Retrier {
+	return &Retrier{policy: p, rand: NewRand(seed), sleep: time.Sleep}
+}
+
+// Delay returns how long to wait after the given (1-based) attempt failed.
+func (r *Retrier) Delay(attempt int) time.Duration {
+	d := r.policy.InitialDelay
+	for i := 1; i < attempt; i++ {
+		if r.policy.MaxDelay > 0 && d >= r.policy.MaxDelay {
+			break
+		}
+		d *= 2
+	}
+	if r.policy.MaxDelay > 0 && d > r.policy.MaxDelay {
+		d = r.policy.MaxDelay
+	}
+	if r.policy.Jitter > 0 {
+		r.mu.Lock()
+		f := r.rand.Float64()
+		r.mu.Unlock()
+		d += time.Duration(float64(d) * r.policy.Jitter * (2*f - 1))
+	}
+	return d
+}
+
+// Do calls fn until it succeeds or the policy says to give up, and returns
+// the last error, if any. Errors wrapped with Permanent aren't retried,
+// and neither are StatusErrors whose code the policy doesn't retry.
+// name describes the operation for logging.
+func (r *Retrier) Do(name string, fn func(attempt int) error) error {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		if err == nil {
+			return nil
+		}
+		if pe, ok := err.(permanentError); ok {
+			return pe.error
+		}
+		if se, ok := err.(*StatusError); ok && !r.policy.RetryableStatus(se.Code) {
+			return err
+		}
+		if r.policy.MaxAttempts > 0 && attempt >= r.policy.MaxAttempts {
+			return err
+		}
+		delay := r.Delay(attempt)
+		if r.policy.MaxElapsed > 0 && time.Since(start)+delay > r.policy.MaxElapsed {
+			log.Printf("[retry] %s failed after %s; giving up: %s", name, time.Since(start), err)
+			return err
+		}
+		log.Printf("[retry] %s failed (attempt %d), retrying in %s: %s", name, attempt, delay, err)
+		r.sleep(delay)
+	}
+}
+
+func init() {
+	flag.DurationVar(&maxElapsedFlag, "retry-max-elapsed", 2*time.Minute,
+		"How long to keep retrying a failed request to Changes")
+	flag.DurationVar(&maxDelayFlag, "retry-max-delay", 30*time.Second,
+		"Maximum time to wait between retries of a failed request to Changes")
+	flag.Float64Var(&jitterFlag, "retry-jitter", 0.2,
+		"Fraction by which to randomly vary the time between retries")
+}
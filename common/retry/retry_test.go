@@ -0,0 +1,87 @@
+package retry
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestRetrier(p Policy) (*Retrier, *[]time.Duration) {
+	r := New(p, "jobstep")
+	var slept []time.Duration
+	r.sleep = func(d time.Duration) { slept = append(slept, d) }
+	return r, &slept
+}
+
+func TestDelay(t *testing.T) {
+	r, _ := newTestRetrier(Policy{InitialDelay: time.Second, MaxDelay: 5 * time.Second})
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, e := range expected {
+		if d := r.Delay(i + 1); d != e {
+			t.Errorf("Attempt %d: expected delay %s, got %s", i+1, e, d)
+		}
+	}
+	if d := r.Delay(1000); d != 5*time.Second {
+		t.Errorf("Expected delay to be capped at 5s, got %s", d)
+	}
+
+	r, _ = newTestRetrier(Policy{InitialDelay: time.Second, Jitter: 0.5})
+	for i := 0; i < 100; i++ {
+		if d := r.Delay(1); d < 500*time.Millisecond || d > 1500*time.Millisecond {
+			t.Fatalf("Delay with jitter out of range: %s", d)
+		}
+	}
+}
+
+func TestDoRetriesUntilSuccess(t *testing.T) {
+	r, slept := newTestRetrier(Policy{InitialDelay: time.Millisecond, StatusClasses: []int{5}})
+	calls := 0
+	err := r.Do("test", func(attempt int) error {
+		calls++
+		if attempt != calls {
+			t.Errorf("Expected attempt %d, got %d", calls, attempt)
+		}
+		switch attempt {
+		case 1:
+			return errors.New("connection reset")
+		case 2:
+			return &StatusError{Code: 503, Message: "unavailable"}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 || len(*slept) != 2 {
+		t.Errorf("Expected 3 calls and 2 sleeps, got %d and %d", calls, len(*slept))
+	}
+}
+
+func TestDoGivesUp(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy Policy
+		err    error
+		calls  int
+	}{
+		{"max attempts", Policy{MaxAttempts: 4}, errors.New("fail"), 4},
+		{"max elapsed", Policy{InitialDelay: time.Hour, MaxElapsed: time.Minute}, errors.New("fail"), 1},
+		{"status", Policy{MaxAttempts: 4, StatusClasses: []int{5}}, &StatusError{Code: 400}, 1},
+		{"status code", Policy{MaxAttempts: 4, StatusCodes: []int{404}}, &StatusError{Code: 404}, 4},
+		{"permanent", Policy{MaxAttempts: 4}, Permanent(errors.New("fail")), 1},
+	}
+	for _, c := range cases {
+		r, _ := newTestRetrier(c.policy)
+		calls := 0
+		err := r.Do("test", func(int) error {
+			calls++
+			return c.err
+		})
+		if err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+		if calls != c.calls {
+			t.Errorf("%s: expected %d calls, got %d", c.name, c.calls, calls)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dropbox/changes-client/client"
+	"github.com/dropbox/changes-client/client/adapter"
+	"github.com/dropbox/changes-client/client/reporter"
+)
+
+// DryRun checks that the build plan in config could be run with the selected
+// adapter and reporter, and writes the plan to w. Nothing is prepared or run,
+// and nothing is reported.
+func DryRun(config *client.Config, w io.Writer) error {
+	reporterName := selectedReporter(config)
+	if _, err := reporter.Create(reporterName); err != nil {
+		return err
+	}
+	if _, err := adapter.Create(selectedAdapterFlag); err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	// Make sure the scripts can be written out, as they would be for a real run.
+	for _, cmdConfig := range config.Cmds {
+		cmd, err := client.NewCommand(cmdConfig.ID, cmdConfig.Script)
+		if err != nil {
+			return fmt.Errorf("Failed to write script for command %s: %s", cmdConfig.ID, err)
+		}
+		os.Remove(cmd.Path)
+	}
+
+	for _, warning := range config.Warnings() {
+		fmt.Fprintf(w, "WARNING: %s\n", warning)
+	}
+	writePlan(w, config, reporterName)
+	return nil
+}
+
+// writePlan describes what running config would do, step by step.
+func writePlan(w io.Writer, config *client.Config, reporterName string) {
+	fmt.Fprintf(w, "Jobstep %s for %s (%s)\n", config.JobstepID, config.Project.Name, config.Project.Slug)
+	fmt.Fprintf(w, "Adapter: %s\n", selectedAdapterFlag)
+	fmt.Fprintf(w, "Reporter: %s\n", reporterName)
+	if config.Snapshot.ID != "" {
+		fmt.Fprintf(w, "Snapshot: %s\n", config.Snapshot.ID)
+	}
+	if outputSnapshotFlag != "" {
+		fmt.Fprintf(w, "Saves snapshot: %s\n", outputSnapshotFlag)
+	}
+	if config.Timeout > 0 {
+		fmt.Fprintf(w, "Timeout: %s\n", time.Duration(config.Timeout)*time.Second)
+	}
+	if config.LogLimit > 0 {
+		fmt.Fprintf(w, "Log limit: %d bytes\n", config.LogLimit)
+	}
+
+	for i, group := range client.GroupCommands(config.Cmds) {
+		if len(group) > 1 {
+			fmt.Fprintf(w, "\nStep %d: %d commands in parallel group %s\n", i+1, len(group), group[0].Group)
+		} else {
+			fmt.Fprintf(w, "\nStep %d:\n", i+1)
+		}
+		for _, cmd := range group {
+			writeCommandPlan(w, cmd)
+		}
+	}
+}
+
+func writeCommandPlan(w io.Writer, cmd client.ConfigCmd) {
+	fmt.Fprintf(w, "  Command %s\n", cmd.ID)
+	if cmd.Type.ID != "" {
+		fmt.Fprintf(w, "    type: %s\n", cmd.Type.ID)
+	}
+	if cmd.IsAlwaysRun() {
+		fmt.Fprintf(w, "    always runs\n")
+	}
+	cond := cmd.Condition
+	if cond.PreviousFailed {
+		fmt.Fprintf(w, "    only if a previous command failed\n")
+	}
+	if cond.Adapter != "" {
+		fmt.Fprintf(w, "    only with the %s adapter\n", cond.Adapter)
+	}
+	if cond.EnvSet != "" {
+		fmt.Fprintf(w, "    only if %s is set\n", cond.EnvSet)
+	}
+	if cond.FileExists != "" {
+		fmt.Fprintf(w, "    only if %s exists\n", cond.FileExists)
+	}
+	if cmd.Cwd != "" {
+		fmt.Fprintf(w, "    cwd: %s\n", cmd.Cwd)
+	}
+	if len(cmd.Env) > 0 {
+		// Only the names, as the values may be secret.
+		var names []string
+		for k := range cmd.Env {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(w, "    env: %s\n", strings.Join(names, ", "))
+	}
+	if len(cmd.Artifacts) > 0 {
+		fmt.Fprintf(w, "    artifacts: %s\n", strings.Join(cmd.Artifacts, ", "))
+	}
+	if cmd.Timeout > 0 {
+		fmt.Fprintf(w, "    timeout: %s\n", time.Duration(cmd.Timeout)*time.Second)
+	}
+	if cmd.LogLimit > 0 {
+		fmt.Fprintf(w, "    log limit: %d bytes\n", cmd.LogLimit)
+	}
+	if cmd.Retry.MaxAttempts > 1 {
+		fmt.Fprintf(w, "    retry: up to %d attempts\n", cmd.Retry.MaxAttempts)
+	}
+	fmt.Fprintf(w, "    script:\n")
+	for _, line := range strings.Split(strings.TrimRight(cmd.Script, "\n"), "\n") {
+		fmt.Fprintf(w, "      %s\n", line)
+	}
+}
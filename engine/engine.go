@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -22,8 +23,13 @@ import (
 
 	_ "github.com/dropbox/changes-client/adapter/basic"
 	_ "github.com/dropbox/changes-client/adapter/lxc"
+	_ "github.com/dropbox/changes-client/adapter/namespace"
+	_ "github.com/dropbox/changes-client/adapter/nspawn"
+	_ "github.com/dropbox/changes-client/adapter/oci"
+	_ "github.com/dropbox/changes-client/adapter/ssh"
 	_ "github.com/dropbox/changes-client/reporter/artifactstore"
 	_ "github.com/dropbox/changes-client/reporter/jenkins"
+	_ "github.com/dropbox/changes-client/reporter/local"
 	_ "github.com/dropbox/changes-client/reporter/mesos"
 	_ "github.com/dropbox/changes-client/reporter/multireporter"
 )
@@ -32,16 +38,24 @@ const (
 	STATUS_QUEUED      = "queued"
 	STATUS_IN_PROGRESS = "in_progress"
 	STATUS_FINISHED    = "finished"
+	STATUS_SKIPPED     = "skipped"
 
 	RESULT_PASSED  Result = "passed"
 	RESULT_FAILED  Result = "failed"
 	RESULT_ABORTED Result = "aborted"
+	// All commands passed, but at least one of them only after being
+	// retried, which suggests that it is flaky.
+	RESULT_FLAKY Result = "flaky"
 	// Test results unreliable or unavailable due to infrastructure
 	// issues.
 	RESULT_INFRA_FAILED Result = "infra_failed"
 
 	SNAPSHOT_ACTIVE = "active"
 	SNAPSHOT_FAILED = "failed"
+
+	// Return code reported for commands killed for running too long;
+	// the same one timeout(1) uses.
+	RETURN_CODE_TIMED_OUT = 124
 )
 
 type Result string
@@ -50,6 +64,16 @@ func (r Result) String() string {
 	return string(r)
 }
 
+// Upstream returns the result as reported to Changes, which has no flaky
+// result. Flaky JobSteps are reported as passed, and can be told apart by
+// the jobstepFlaky metric and the attempt numbers of their commands.
+func (r Result) Upstream() string {
+	if r == RESULT_FLAKY {
+		return RESULT_PASSED.String()
+	}
+	return r.String()
+}
+
 // Convenience method to check for all types of failure.
 func (r Result) IsFailure() bool {
 	switch r {
@@ -59,11 +83,25 @@ func (r Result) IsFailure() bool {
 	return false
 }
 
+// Convenience method to check for results where every command passed.
+func (r Result) IsPassing() bool {
+	switch r {
+	case RESULT_PASSED, RESULT_FLAKY:
+		return true
+	}
+	return false
+}
+
 var (
 	selectedAdapterFlag  string
 	selectedReporterFlag string
 	outputSnapshotFlag   string
 	useExternalEnvFlag   bool
+	killGracePeriodFlag  int
+	eventLogFlag         string
+	separateStderrFlag   bool
+	logTailSizeFlag      int
+	keepFullLogsFlag     bool
 )
 
 type Engine struct {
@@ -71,12 +109,39 @@ type Engine struct {
 	clientLog *client.Log
 	adapter   adapter.Adapter
 	reporter  reporter.Reporter
+	events    *EventLog
+
+	// Guards logStats.
+	logStatsMu sync.Mutex
+	// Combined stats of the logs of commands that have finished.
+	logStats client.LogStats
+	// Shared by all commands' logs if the JobStep's output is limited.
+	logBudget *client.LogBudget
+}
+
+// Returns the name of the reporter to use. Builds run from a config file have
+// no server to report to, so they report locally unless told otherwise.
+func selectedReporter(config *client.Config) string {
+	if config.ConfigFile == "" {
+		return selectedReporterFlag
+	}
+	explicit := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "reporter" {
+			explicit = true
+		}
+	})
+	if explicit {
+		return selectedReporterFlag
+	}
+	return "local"
 }
 
 func RunBuildPlan(config *client.Config, infraLog *filelog.FileLog) (Result, error) {
-	currentReporter, err := reporter.Create(selectedReporterFlag)
+	reporterName := selectedReporter(config)
+	currentReporter, err := reporter.Create(reporterName)
 	if err != nil {
-		log.Printf("[engine] failed to initialize reporter: %s", selectedReporterFlag)
+		log.Printf("[engine] failed to initialize reporter: %s", reporterName)
 		return RESULT_INFRA_FAILED, err
 	}
 	currentReporter.Init(config)
@@ -92,13 +157,25 @@ func RunBuildPlan(config *client.Config, infraLog *filelog.FileLog) (Result, err
 		return RESULT_INFRA_FAILED, err
 	}
 
-	log.Printf("[engine] started with reporter %s, adapter %s", selectedReporterFlag, selectedAdapterFlag)
+	var events *EventLog
+	if eventLogFlag != "" {
+		if events, err = OpenEventLog(eventLogFlag, config.JobstepID); err != nil {
+			// Not worth failing the build over.
+			log.Printf("[engine] failed to open event log %s: %s", eventLogFlag, err)
+			sentry.Error(err, map[string]string{})
+		} else {
+			defer events.Close()
+		}
+	}
+
+	log.Printf("[engine] started with reporter %s, adapter %s", reporterName, selectedAdapterFlag)
 
 	engine := &Engine{
 		config:    config,
 		clientLog: client.NewLog(),
 		adapter:   currentAdapter,
 		reporter:  currentReporter,
+		events:    events,
 	}
 
 	return engine.Run()
@@ -149,6 +226,7 @@ func (e *Engine) Run() (Result, error) {
 	}
 
 	e.reporter.PushJobstepStatus(STATUS_IN_PROGRESS, "")
+	e.events.Write(Event{Type: EVENT_JOBSTEP_STARTED})
 
 	result, err := e.runBuildPlan()
 
@@ -157,7 +235,20 @@ func (e *Engine) Run() (Result, error) {
 		e.clientLog.Printf("==> Error: %s", err)
 	}
 
-	e.reporter.PushJobstepStatus(STATUS_FINISHED, result.String())
+	// The console log is still open, but reporting this after the JobStep has
+	// finished would be too late.
+	logStats := e.commandLogStats()
+	logStats.Add(e.clientLog.Stats())
+	metrics := logStats.Metrics()
+	if result == RESULT_FLAKY {
+		metrics["jobstepFlaky"] = 1
+	} else {
+		metrics["jobstepFlaky"] = 0
+	}
+	e.reporter.ReportMetrics(metrics)
+
+	e.reporter.PushJobstepStatus(STATUS_FINISHED, result.Upstream())
+	e.events.Write(Event{Type: EVENT_JOBSTEP_FINISHED, Result: result.String(), Error: errorString(err)})
 
 	e.clientLog.Close()
 	wg.Wait()
@@ -165,75 +256,416 @@ func (e *Engine) Run() (Result, error) {
 	return result, err
 }
 
-func (e *Engine) executeCommands() (Result, error) {
-	for _, cmdConfig := range e.config.Cmds {
-		e.clientLog.Printf("==> Running command %s", cmdConfig.ID)
-		e.clientLog.Printf("==>     with script %s", cmdConfig.Script)
-		cmd, err := client.NewCommand(cmdConfig.ID, cmdConfig.Script)
-		if err != nil {
-			e.reporter.PushCommandStatus(cmd.ID, STATUS_FINISHED, 255)
-			e.clientLog.Printf("==> Error creating command script: %s", err)
-			return RESULT_INFRA_FAILED, err
+// Returns a context that is done after the given number of seconds,
+// or a plain child of ctx if seconds is not positive.
+func withTimeout(ctx context.Context, seconds int) (context.Context, context.CancelFunc) {
+	if seconds <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+}
+
+func (e *Engine) executeCommands(ctx context.Context) (Result, error) {
+	jobCtx, cancelJob := withTimeout(ctx, e.config.Timeout)
+	defer cancelJob()
+	if e.config.LogLimit > 0 {
+		e.logBudget = client.NewLogBudget(e.config.LogLimit)
+	}
+
+	finalResult := RESULT_PASSED
+	var finalErr error
+	for _, group := range client.GroupCommands(e.config.Cmds) {
+		afterFailure := group[0].RunsAfterFailure()
+		if !finalResult.IsPassing() && !afterFailure {
+			continue
 		}
-		e.reporter.PushCommandStatus(cmd.ID, STATUS_IN_PROGRESS, -1)
 
-		cmd.CaptureOutput = cmdConfig.CaptureOutput
+		var toRun []client.ConfigCmd
+		for _, cmdConfig := range group {
+			if reason := e.skipReason(cmdConfig, finalResult); reason != "" {
+				e.clientLog.Printf("==> Skipping command %s: %s", cmdConfig.ID, reason)
+				e.reporter.PushCommandStatus(cmdConfig.ID, STATUS_SKIPPED, -1, 1, nil)
+				e.events.Write(Event{Type: EVENT_COMMAND_SKIPPED, CommandID: cmdConfig.ID, Reason: reason})
+			} else {
+				toRun = append(toRun, cmdConfig)
+			}
+		}
+		if len(toRun) == 0 {
+			continue
+		}
+
+		groupCtx := jobCtx
+		if afterFailure {
+			// These must run even once the build has been aborted or has timed out.
+			groupCtx = context.Background()
+			if !finalResult.IsPassing() {
+				e.clientLog.Printf("==> Running cleanup commands after build %s", finalResult)
+			}
+		}
 
-		var env []string
-		// Some of our setups rely on external environment
-		// variables, in which case we pass through our
-		// entire environment to any commands we run.
-		if useExternalEnvFlag {
-			env = os.Environ()
+		var result Result
+		var err error
+		// Whether output goes to the console depends only on the build
+		// plan, even if all but one command in a group was skipped.
+		if len(group) == 1 {
+			result, err = e.runCommandLogged(groupCtx, toRun[0], e.clientLog)
+		} else {
+			result, err = e.runParallelCommands(groupCtx, toRun)
+		}
+		if afterFailure {
+			// Always-run and on-failure commands report their own status,
+			// but don't affect the result of the build.
+			if err != nil {
+				e.clientLog.Printf("==> Error in cleanup command: %s", err)
+			}
+			continue
 		}
-		for k, v := range cmdConfig.Env {
-			env = append(env, k+"="+v)
+		if err != nil || !result.IsPassing() {
+			finalResult, finalErr = result, err
+		} else if result == RESULT_FLAKY {
+			finalResult = RESULT_FLAKY
 		}
-		cmd.Env = env
+	}
 
-		if len(cmdConfig.Cwd) > 0 {
-			cmd.Cwd = cmdConfig.Cwd
+	if finalResult.IsPassing() {
+		// Made it through all commands without failure. Success.
+		return finalResult, nil
+	}
+	return finalResult, finalErr
+}
+
+// skipReason returns why the command shouldn't run given the result of the
+// build so far, or an empty string if its conditions are all met.
+func (e *Engine) skipReason(cmdConfig client.ConfigCmd, resultSoFar Result) string {
+	cond := cmdConfig.Condition
+	if cond.PreviousFailed && !resultSoFar.IsFailure() {
+		return "no previous command failed"
+	}
+	if cond.Adapter != "" && cond.Adapter != selectedAdapterFlag {
+		return fmt.Sprintf("only runs with the %s adapter", cond.Adapter)
+	}
+	if cond.EnvSet != "" {
+		_, set := cmdConfig.Env[cond.EnvSet]
+		if !set && useExternalEnvFlag {
+			_, set = os.LookupEnv(cond.EnvSet)
 		}
+		if !set {
+			return fmt.Sprintf("environment variable %s is not set", cond.EnvSet)
+		}
+	}
+	if cond.FileExists != "" {
+		path := cond.FileExists
+		if filepath.IsAbs(path) {
+			path = filepath.Join(e.adapter.GetRootFs(), path)
+		} else {
+			path = filepath.Join(e.adapter.GetArtifactRoot(), path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Sprintf("file %s does not exist", cond.FileExists)
+		}
+	}
+	return ""
+}
+
+// Orders results from least to most severe, for combining the results
+// of commands that ran together.
+var resultSeverity = map[Result]int{
+	RESULT_PASSED:       0,
+	RESULT_FLAKY:        1,
+	RESULT_FAILED:       2,
+	RESULT_ABORTED:      3,
+	RESULT_INFRA_FAILED: 4,
+}
 
-		cmdResult, err := e.adapter.Run(cmd, e.clientLog)
+// The name of the log source that a command's output is sent to, in addition
+// to the console unless it can't share it with other commands.
+func commandLogSource(cmdID string) string {
+	return "cmd-" + cmdID
+}
+
+// The name of the log source that a command's stderr is sent to, when it is
+// kept separate.
+func commandStderrLogSource(cmdID string) string {
+	return commandLogSource(cmdID) + ".stderr"
+}
+
+// runParallelCommands runs all of cmds concurrently, each logging to its own
+// source rather than to the console, and returns the most severe result
+// along with its error, if any.
+func (e *Engine) runParallelCommands(jobCtx context.Context, cmds []client.ConfigCmd) (Result, error) {
+	e.clientLog.Printf("==> Running %d commands in parallel group %s", len(cmds), cmds[0].Group)
+
+	type cmdResult struct {
+		result Result
+		err    error
+	}
+	results := make([]cmdResult, len(cmds))
+	var wg sync.WaitGroup
+	for i, cmdConfig := range cmds {
+		wg.Add(1)
+		go func(i int, cmdConfig client.ConfigCmd) {
+			defer wg.Done()
+			source := commandLogSource(cmdConfig.ID)
+			e.clientLog.Printf("==> Started command %s; output is logged to %s", cmdConfig.ID, source)
+
+			r, err := e.runCommandLogged(jobCtx, cmdConfig, nil)
+
+			e.clientLog.Printf("==> Command %s finished: %s", cmdConfig.ID, r)
+			if err != nil {
+				e.clientLog.Printf("==> Error: %s", err)
+			}
+			results[i] = cmdResult{r, err}
+		}(i, cmdConfig)
+	}
+	wg.Wait()
 
-		if err != nil {
-			e.reporter.PushCommandStatus(cmd.ID, STATUS_FINISHED, 255)
-			e.clientLog.Printf("==> Error running command: %s", err)
+	worst := results[0]
+	for _, r := range results[1:] {
+		if resultSeverity[r.result] > resultSeverity[worst.result] {
+			worst = r
+		}
+	}
+	return worst.result, worst.err
+}
+
+// runCommandLogged runs a single command from the build plan, logging its
+// output to its own source, as well as to console if it isn't nil.
+func (e *Engine) runCommandLogged(jobCtx context.Context, cmdConfig client.ConfigCmd, console *client.Log) (Result, error) {
+	var cmdLog *client.Log
+	if console != nil {
+		cmdLog = client.NewTeeLog(console)
+	} else {
+		cmdLog = client.NewLog()
+	}
+	fullLogPath := e.limitOutput(cmdLog, cmdConfig)
+	reported := make(chan struct{})
+	go func() {
+		reportLogChunks(commandLogSource(cmdConfig.ID), cmdLog, e.reporter)
+		close(reported)
+	}()
+	r, err := e.runCommand(jobCtx, cmdConfig, cmdLog)
+	cmdLog.Close()
+	<-reported
+	e.addLogStats(cmdLog.Stats())
+	if fullLogPath != "" && !cmdLog.OutputTruncated() {
+		// It was only needed if the log was truncated.
+		os.Remove(fullLogPath)
+	}
+	return r, err
+}
+
+// The name of the file in the artifact root that a command's full output is
+// saved to, in case its log is truncated.
+func fullLogName(cmdID string) string {
+	return "changes-client-" + cmdID + ".log"
+}
+
+// limitOutput applies the command's and the JobStep's output limits to
+// cmdLog, if there are any, and returns the path its full output is saved to,
+// if it is.
+func (e *Engine) limitOutput(cmdLog *client.Log, cmdConfig client.ConfigCmd) string {
+	limit := client.OutputLimit{Bytes: cmdConfig.LogLimit, Shared: e.logBudget, TailSize: logTailSizeFlag}
+	if limit.Bytes == 0 && limit.Shared == nil {
+		return ""
+	}
+	var fullLogPath string
+	if keepFullLogsFlag {
+		fullLogPath = filepath.Join(e.adapter.GetArtifactRoot(), fullLogName(cmdConfig.ID))
+		if f, err := os.Create(fullLogPath); err != nil {
+			log.Printf("[engine] Failed to create full log for command %s: %s", cmdConfig.ID, err)
+			fullLogPath = ""
+		} else {
+			limit.Full = f
+		}
+	}
+	cmdLog.LimitOutput(limit)
+	return fullLogPath
+}
+
+// addLogStats records the stats of a command's log once it is closed.
+func (e *Engine) addLogStats(stats client.LogStats) {
+	e.logStatsMu.Lock()
+	defer e.logStatsMu.Unlock()
+	e.logStats.Add(stats)
+}
+
+func (e *Engine) commandLogStats() client.LogStats {
+	e.logStatsMu.Lock()
+	defer e.logStatsMu.Unlock()
+	return e.logStats
+}
+
+// runCommand runs a single command from the build plan, logging its output
+// to clientLog, and reports its status and artifacts.
+func (e *Engine) runCommand(jobCtx context.Context, cmdConfig client.ConfigCmd, clientLog *client.Log) (Result, error) {
+	clientLog.Printf("==> Running command %s", cmdConfig.ID)
+	clientLog.Printf("==>     with script %s", cmdConfig.Script)
+	cmd, err := client.NewCommand(cmdConfig.ID, cmdConfig.Script)
+	if err != nil {
+		e.reporter.PushCommandStatus(cmdConfig.ID, STATUS_FINISHED, 255, 1, nil)
+		e.commandFinishedEvent(cmdConfig.ID, 1, 255, time.Now(), err)
+		clientLog.Printf("==> Error creating command script: %s", err)
+		return RESULT_INFRA_FAILED, err
+	}
+	cmdEnv, err := client.ExpandEnv(cmdConfig.Env, os.LookupEnv)
+	if err != nil {
+		e.reporter.PushCommandStatus(cmdConfig.ID, STATUS_FINISHED, 255, 1, nil)
+		e.commandFinishedEvent(cmdConfig.ID, 1, 255, time.Now(), err)
+		clientLog.Printf("==> Error resolving environment: %s", err)
+		return RESULT_INFRA_FAILED, err
+	}
+	e.reporter.PushCommandStatus(cmd.ID, STATUS_IN_PROGRESS, -1, 1, nil)
+
+	cmd.CaptureOutput = cmdConfig.CaptureOutput
+	cmd.KillGracePeriod = time.Duration(killGracePeriodFlag) * time.Second
+
+	var env []string
+	// Some of our setups rely on external environment
+	// variables, in which case we pass through our
+	// entire environment to any commands we run.
+	if useExternalEnvFlag {
+		env = os.Environ()
+	}
+	for k, v := range cmdEnv {
+		cmd.ConfigEnv = append(cmd.ConfigEnv, k+"="+v)
+	}
+	cmd.Env = append(env, cmd.ConfigEnv...)
+
+	if len(cmdConfig.Cwd) > 0 {
+		cmd.Cwd = cmdConfig.Cwd
+	}
+
+	if separateStderrFlag {
+		stderrLog := client.NewLog()
+		reported := make(chan struct{})
+		go func() {
+			reportLogChunks(commandStderrLogSource(cmd.ID), stderrLog, e.reporter)
+			close(reported)
+		}()
+		defer func() {
+			stderrLog.Close()
+			<-reported
+			e.addLogStats(stderrLog.Stats())
+		}()
+		if cmdConfig.LogLimit > 0 {
+			// The JobStep's limit only counts the combined output.
+			stderrLog.LimitOutput(client.OutputLimit{Bytes: cmdConfig.LogLimit, TailSize: logTailSizeFlag})
+		}
+		cmd.Stderr = stderrLog
+	}
+
+	maxAttempts := cmdConfig.Retry.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	var result Result
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			clientLog.Printf("==> Retrying command %s (attempt %d of %d)", cmd.ID, attempt, maxAttempts)
+			e.reporter.PushCommandStatus(cmd.ID, STATUS_IN_PROGRESS, -1, attempt, nil)
+		}
+		e.events.Write(Event{Type: EVENT_COMMAND_STARTED, CommandID: cmd.ID, Attempt: attempt})
+		start := time.Now()
+
+		cmdCtx, cancelCmd := withTimeout(jobCtx, cmdConfig.Timeout)
+		cmdResult, err := e.adapter.Run(cmdCtx, cmd, clientLog)
+		cmdCtxErr := cmdCtx.Err()
+		cancelCmd()
+
+		if cmdCtxErr == context.Canceled {
+			// The build was aborted, so the command was killed; report
+			// how it ended, but nothing more is run or collected for it.
+			exitCode := 255
+			if cmdResult != nil {
+				exitCode = cmdResult.ReturnCode()
+			}
+			e.reporter.PushCommandStatus(cmd.ID, STATUS_FINISHED, exitCode, attempt, cmdResult)
+			e.commandFinishedEvent(cmd.ID, attempt, exitCode, start, err)
+			return RESULT_ABORTED, nil
+		}
+		timedOut := cmdCtxErr == context.DeadlineExceeded
+		if timedOut {
+			if jobCtx.Err() == context.DeadlineExceeded {
+				clientLog.Printf("==> Jobstep timed out after %s", time.Duration(e.config.Timeout)*time.Second)
+			} else {
+				clientLog.Printf("==> Command %s timed out after %s", cmd.ID, time.Duration(cmdConfig.Timeout)*time.Second)
+			}
+		} else if err != nil {
+			e.reporter.PushCommandStatus(cmd.ID, STATUS_FINISHED, 255, attempt, nil)
+			e.commandFinishedEvent(cmd.ID, attempt, 255, start, err)
+			clientLog.Printf("==> Error running command: %s", err)
 			return RESULT_INFRA_FAILED, err
 		}
-		result := RESULT_FAILED
-		if cmdResult.Success {
+
+		if !timedOut && cmdResult.Success {
 			result = RESULT_PASSED
+			if attempt > 1 {
+				clientLog.Printf("==> Command %s passed after %d attempts", cmd.ID, attempt)
+				result = RESULT_FLAKY
+			}
 			if cmd.CaptureOutput {
-				e.reporter.PushCommandOutput(cmd.ID, STATUS_FINISHED, 0, cmdResult.Output)
+				e.reporter.PushCommandOutput(cmd.ID, STATUS_FINISHED, 0, attempt, cmdResult, cmdResult.Output)
 			} else {
-				e.reporter.PushCommandStatus(cmd.ID, STATUS_FINISHED, 0)
-			}
-		} else {
-			e.reporter.PushCommandStatus(cmd.ID, STATUS_FINISHED, 1)
-			// infra_setup commands are generated and owned by Changes, so when they fail,
-			// it is an infrastructural failure.
-			if cmdConfig.Type.ID == "infra_setup" {
-				return RESULT_INFRA_FAILED,
-					fmt.Errorf("Failure while executing infrastructural setup command %s", cmdConfig.ID)
+				e.reporter.PushCommandStatus(cmd.ID, STATUS_FINISHED, 0, attempt, cmdResult)
 			}
+			e.commandFinishedEvent(cmd.ID, attempt, 0, start, nil)
+			break
 		}
 
-		t0 := time.Now()
-		if err := e.reporter.PublishArtifacts(cmdConfig, e.adapter, e.clientLog); err != nil {
-			e.clientLog.Printf("==> PublishArtifacts Error: %s after %s", err, time.Since(t0))
-			return RESULT_INFRA_FAILED, err
+		exitCode := RETURN_CODE_TIMED_OUT
+		if !timedOut {
+			exitCode = cmdResult.ReturnCode()
+		}
+		// A command that timed out may still have a result if it was killed.
+		e.reporter.PushCommandStatus(cmd.ID, STATUS_FINISHED, exitCode, attempt, cmdResult)
+		e.commandFinishedEvent(cmd.ID, attempt, exitCode, start, nil)
+		if attempt < maxAttempts && jobCtx.Err() == nil && cmdConfig.Retry.IsRetryable(exitCode) {
+			delay := cmdConfig.Retry.Delay(attempt)
+			clientLog.Printf("==> Command %s failed with exit code %d; retrying in %s", cmd.ID, exitCode, delay)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-jobCtx.Done():
+				if jobCtx.Err() == context.Canceled {
+					return RESULT_ABORTED, nil
+				}
+				clientLog.Printf("==> Jobstep timed out after %s", time.Duration(e.config.Timeout)*time.Second)
+			}
 		}
-		log.Printf("Took %s to publish artifacts.", time.Since(t0))
 
-		if result.IsFailure() {
-			return result, nil
+		// infra_setup commands are generated and owned by Changes, so when they fail,
+		// it is an infrastructural failure.
+		if cmdConfig.Type.ID == "infra_setup" {
+			return RESULT_INFRA_FAILED,
+				fmt.Errorf("Failure while executing infrastructural setup command %s", cmdConfig.ID)
 		}
+		result = RESULT_FAILED
+		break
 	}
 
-	// Made it through all commands without failure. Success.
-	return RESULT_PASSED, nil
+	if keepFullLogsFlag && clientLog.OutputTruncated() {
+		clientLog.Printf("==> Full output of command %s is saved as artifact %s", cmd.ID, fullLogName(cmd.ID))
+		cmdConfig.Artifacts = append(append([]string(nil), cmdConfig.Artifacts...), "/"+fullLogName(cmd.ID))
+	}
+
+	t0 := time.Now()
+	err = e.reporter.PublishArtifacts(cmdConfig, e.adapter, clientLog)
+	e.events.Write(Event{Type: EVENT_ARTIFACTS_PUBLISHED, CommandID: cmd.ID,
+		Duration: time.Since(t0).Seconds(), Error: errorString(err)})
+	if err != nil {
+		clientLog.Printf("==> PublishArtifacts Error: %s after %s", err, time.Since(t0))
+		return RESULT_INFRA_FAILED, err
+	}
+	log.Printf("Took %s to publish artifacts.", time.Since(t0))
+
+	return result, nil
+}
+
+// Records in the event log that an attempt at running a command that began
+// at start has finished with the given exit code.
+func (e *Engine) commandFinishedEvent(cmdID string, attempt int, exitCode int, start time.Time, err error) {
+	e.events.Write(Event{Type: EVENT_COMMAND_FINISHED, CommandID: cmdID, Attempt: attempt,
+		ExitCode: &exitCode, Duration: time.Since(start).Seconds(), Error: errorString(err)})
 }
 
 func (e *Engine) captureSnapshot() error {
@@ -254,6 +686,29 @@ func (e *Engine) runBuildPlan() (Result, error) {
 		return RESULT_INFRA_FAILED, errors.New("Infra failure forced for debugging")
 	}
 
+	// Better to fail clearly now than to fail strangely later, or worse, pass.
+	if err := e.config.Validate(); err != nil {
+		if verrs, ok := err.(client.ValidationErrors); ok {
+			for _, v := range verrs {
+				e.clientLog.Printf("==> ERROR: Invalid config: %s", v)
+			}
+		}
+		return RESULT_INFRA_FAILED, err
+	}
+	for _, w := range e.config.Warnings() {
+		e.clientLog.Printf("==> WARNING: %s", w)
+	}
+	if err := e.config.Redact.Apply(); err != nil {
+		return RESULT_INFRA_FAILED, err
+	}
+	var logTimestamps string
+	if _, err := e.config.GetDebugConfig("logTimestamps", &logTimestamps); err != nil {
+		return RESULT_INFRA_FAILED, err
+	}
+	if err := client.SetLogTimestamps(logTimestamps); err != nil {
+		return RESULT_INFRA_FAILED, err
+	}
+
 	ctx, cancelFunc := context.WithCancel(context.Background())
 
 	// capture ctrl+c and enforce a clean shutdown
@@ -292,14 +747,20 @@ func (e *Engine) runBuildPlan() (Result, error) {
 		return RESULT_INFRA_FAILED, err
 	}
 
+	prepareStart := time.Now()
 	metrics, err := e.adapter.Prepare(e.clientLog)
+	e.events.Write(Event{Type: EVENT_ADAPTER_PREPARED,
+		Duration: time.Since(prepareStart).Seconds(), Error: errorString(err)})
 	if err != nil {
 		log.Printf("[adapter] %s", err)
 		e.clientLog.Printf("==> ERROR: %s adapter failed to prepare: %s", selectedAdapterFlag, err)
 		return RESULT_INFRA_FAILED, err
 	}
 	defer func(engine *Engine) {
+		shutdownStart := time.Now()
 		shutdownMetrics, shutdownErr := engine.adapter.Shutdown(engine.clientLog)
+		engine.events.Write(Event{Type: EVENT_ADAPTER_SHUTDOWN,
+			Duration: time.Since(shutdownStart).Seconds(), Error: errorString(shutdownErr)})
 		if shutdownErr != nil {
 			log.Printf("[adapter] Error during shutdown: %s", err)
 		}
@@ -314,7 +775,7 @@ func (e *Engine) runBuildPlan() (Result, error) {
 	// actually begin executing the build plan
 	finished := make(chan cmdResult)
 	go func() {
-		r, cmderr := e.executeCommands()
+		r, cmderr := e.executeCommands(ctx)
 		finished <- cmdResult{r, cmderr}
 	}()
 
@@ -327,17 +788,23 @@ func (e *Engine) runBuildPlan() (Result, error) {
 		result = cmdresult.result
 	case <-ctx.Done():
 		e.clientLog.Printf("==> ERROR: Build was aborted by upstream")
+		// Running commands are killed, but always-run commands still need to
+		// finish before the adapter is shut down.
+		<-finished
 		return RESULT_ABORTED, nil
 	}
 
-	if result == RESULT_PASSED && e.outputSnapshotID() != "" {
+	if result.IsPassing() && e.outputSnapshotID() != "" {
 		var snapshotStatus string
+		snapshotStart := time.Now()
 		sserr := e.captureSnapshot()
 		if sserr != nil {
 			snapshotStatus = SNAPSHOT_FAILED
 		} else {
 			snapshotStatus = SNAPSHOT_ACTIVE
 		}
+		e.events.Write(Event{Type: EVENT_SNAPSHOT_CAPTURED, SnapshotID: e.outputSnapshotID(),
+			Result: snapshotStatus, Duration: time.Since(snapshotStart).Seconds(), Error: errorString(sserr)})
 		if err := e.reporter.PushSnapshotImageStatus(e.outputSnapshotID(), snapshotStatus); err != nil {
 			log.Printf("Failed to push snapshot image status: %s", err)
 			if sserr == nil {
@@ -362,4 +829,9 @@ func init() {
 	flag.StringVar(&selectedReporterFlag, "reporter", "multireporter", "Reporter to send results to")
 	flag.StringVar(&outputSnapshotFlag, "save-snapshot", "", "Save the resulting container snapshot")
 	flag.BoolVar(&useExternalEnvFlag, "use-external-env", true, "Whether to pass through changes-client's external environment to the commands it runs")
+	flag.StringVar(&eventLogFlag, "event-log", "", "Append newline-delimited JSON events for the JobStep lifecycle to this file, or to file descriptor N if \"fd:N\"")
+	flag.BoolVar(&separateStderrFlag, "separate-stderr", false, "Also report each command's stderr as its own log, alongside the combined output")
+	flag.IntVar(&logTailSizeFlag, "log-tail-size", 64*1024, "Bytes at the end of a command's output to report when its log limit is exceeded")
+	flag.BoolVar(&keepFullLogsFlag, "keep-full-logs", false, "Save the full output of commands with log limits, and publish it as an artifact if the limit is exceeded")
+	flag.IntVar(&killGracePeriodFlag, "kill-grace-period", 10, "Seconds a command has to exit after SIGTERM when aborted or timed out, before it is killed")
 }
@@ -1,14 +1,29 @@
 package engine
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"golang.org/x/net/context"
+
+	basicadapter "github.com/dropbox/changes-client/adapter/basic"
 	"github.com/dropbox/changes-client/client"
 	"github.com/dropbox/changes-client/client/adapter"
 	"github.com/dropbox/changes-client/client/reporter"
+	localreporter "github.com/dropbox/changes-client/reporter/local"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type noartReporter struct {
@@ -21,6 +36,10 @@ func (nar *noartReporter) PublishArtifacts(_ client.ConfigCmd, _ adapter.Adapter
 
 type noopAdapter struct {
 	cmdIdsToFail map[string]bool
+	cmdIdsToHang map[string]bool
+	// Guards failuresLeft, which is decremented by Run.
+	mu           sync.Mutex
+	failuresLeft map[string]int
 }
 
 // FailCommandForTest takes a Command ID, and ensures that any Command with that
@@ -32,13 +51,46 @@ func (na *noopAdapter) FailCommandForTest(id string) {
 	na.cmdIdsToFail[id] = true
 }
 
+// HangCommandForTest takes a Command ID, and ensures that any Command with that
+// id passed to Run won't finish until its context is done, and then fails as
+// if it were killed.
+func (na *noopAdapter) HangCommandForTest(id string) {
+	if na.cmdIdsToHang == nil {
+		na.cmdIdsToHang = make(map[string]bool)
+	}
+	na.cmdIdsToHang[id] = true
+}
+
+// FailCommandTimesForTest takes a Command ID, and ensures that the first n
+// times a Command with that id is passed to Run, it fails with exit code 3.
+func (na *noopAdapter) FailCommandTimesForTest(id string, n int) {
+	if na.failuresLeft == nil {
+		na.failuresLeft = make(map[string]int)
+	}
+	na.failuresLeft[id] = n
+}
+
 func (_ *noopAdapter) Init(*client.Config) error                   { return nil }
 func (_ *noopAdapter) Prepare(*client.Log) (client.Metrics, error) { return nil, nil }
-func (na *noopAdapter) Run(cmd *client.Command, _ *client.Log) (*client.CommandResult, error) {
+func (na *noopAdapter) Run(ctx context.Context, cmd *client.Command, _ *client.Log) (*client.CommandResult, error) {
+	if na.cmdIdsToHang[cmd.ID] {
+		<-ctx.Done()
+		return &client.CommandResult{Success: false, ExitCode: -1, Signal: syscall.SIGKILL}, nil
+	}
+	na.mu.Lock()
+	defer na.mu.Unlock()
+	if na.failuresLeft[cmd.ID] > 0 {
+		na.failuresLeft[cmd.ID]--
+		return &client.CommandResult{Success: false, ExitCode: 3}, nil
+	}
 	fail := na.cmdIdsToFail[cmd.ID]
-	return &client.CommandResult{
+	result := &client.CommandResult{
 		Success: !fail,
-	}, nil
+	}
+	if fail {
+		result.ExitCode = 1
+	}
+	return result, nil
 }
 func (_ *noopAdapter) Shutdown(*client.Log) (client.Metrics, error) { return nil, nil }
 func (_ *noopAdapter) CaptureSnapshot(string, *client.Log) error    { return nil }
@@ -63,7 +115,7 @@ func TestFailedArtifactInfraFails(t *testing.T) {
 		config: &client.Config{Cmds: []client.ConfigCmd{
 			{Artifacts: []string{"result.xml"}},
 		}}}
-	r, e := eng.executeCommands()
+	r, e := eng.executeCommands(context.Background())
 	assert.Equal(t, r, RESULT_INFRA_FAILED)
 	assert.Error(t, e)
 }
@@ -84,6 +136,23 @@ func TestDebugForceInfraFailure(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestInvalidConfigFailsInfra(t *testing.T) {
+	config, err := client.LoadConfig([]byte(`{"project": {"slug": "foo"}}`))
+	assert.NoError(t, err)
+	log := client.NewLog()
+	defer log.Close()
+	go log.Drain()
+	eng := Engine{reporter: &reporter.NoopReporter{},
+		clientLog: log,
+		adapter:   &noopAdapter{},
+		config:    config,
+	}
+
+	result, err := eng.runBuildPlan()
+	assert.Equal(t, RESULT_INFRA_FAILED, result)
+	assert.IsType(t, client.ValidationErrors{}, err)
+}
+
 func TestInfraSetupCommandFailsInfra(t *testing.T) {
 	cmd := client.ConfigCmd{ID: "failme1234", Script: "exit 1"}
 	cmd.Type.ID = "infra_setup"
@@ -105,6 +174,557 @@ func TestInfraSetupCommandFailsInfra(t *testing.T) {
 	assert.Error(t, err)
 }
 
+type statusReporter struct {
+	reporter.NoopReporter
+	mu         sync.Mutex
+	retCodes   map[string]int
+	attempts   map[string]int
+	skipped    []string
+	logSources map[string]bool
+	logs       map[string]string
+	jobstep    []string
+	metrics    client.Metrics
+}
+
+func newStatusReporter() *statusReporter {
+	return &statusReporter{
+		retCodes:   make(map[string]int),
+		attempts:   make(map[string]int),
+		logSources: make(map[string]bool),
+		logs:       make(map[string]string),
+	}
+}
+
+func (sr *statusReporter) PushCommandStatus(cID string, status string, retCode int, attempt int, result *client.CommandResult) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if status == STATUS_FINISHED {
+		sr.retCodes[cID] = retCode
+		sr.attempts[cID] = attempt
+	} else if status == STATUS_SKIPPED {
+		sr.skipped = append(sr.skipped, cID)
+	}
+}
+
+func (sr *statusReporter) PushJobstepStatus(status string, result string) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.jobstep = append(sr.jobstep, status+" "+result)
+}
+
+func (sr *statusReporter) ReportMetrics(metrics client.Metrics) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if sr.metrics == nil {
+		sr.metrics = client.Metrics{}
+	}
+	for k, v := range metrics {
+		sr.metrics[k] = v
+	}
+}
+
+func (sr *statusReporter) PushLogChunk(source string, payload []byte) bool {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.logSources[source] = true
+	sr.logs[source] += string(payload)
+	return true
+}
+
+func TestCommandTimeout(t *testing.T) {
+	hang := client.ConfigCmd{ID: "hang", Script: "sleep 1000", Timeout: 1}
+	never := client.ConfigCmd{ID: "never", Script: "true"}
+	adapter := &noopAdapter{}
+	adapter.HangCommandForTest(hang.ID)
+	rep := newStatusReporter()
+	log := client.NewLog()
+	defer log.Close()
+	go log.Drain()
+	eng := Engine{reporter: rep,
+		clientLog: log,
+		adapter:   adapter,
+		config: &client.Config{
+			Cmds: []client.ConfigCmd{hang, never},
+		},
+	}
+
+	result, err := eng.executeCommands(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, RESULT_FAILED, result)
+	assert.Equal(t, map[string]int{"hang": RETURN_CODE_TIMED_OUT}, rep.retCodes)
+}
+
+func TestJobstepTimeout(t *testing.T) {
+	first := client.ConfigCmd{ID: "first", Script: "true"}
+	hang := client.ConfigCmd{ID: "hang", Script: "sleep 1000"}
+	adapter := &noopAdapter{}
+	adapter.HangCommandForTest(hang.ID)
+	rep := newStatusReporter()
+	log := client.NewLog()
+	defer log.Close()
+	go log.Drain()
+	eng := Engine{reporter: rep,
+		clientLog: log,
+		adapter:   adapter,
+		config: &client.Config{
+			Cmds:    []client.ConfigCmd{first, hang},
+			Timeout: 1,
+		},
+	}
+
+	result, err := eng.executeCommands(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, RESULT_FAILED, result)
+	assert.Equal(t, map[string]int{"first": 0, "hang": RETURN_CODE_TIMED_OUT}, rep.retCodes)
+}
+
+func TestAlwaysRunAfterFailure(t *testing.T) {
+	fail := client.ConfigCmd{ID: "fail", Script: "false"}
+	skipped := client.ConfigCmd{ID: "skipped", Script: "true"}
+	cleanup := client.ConfigCmd{ID: "cleanup", Script: "true", AlwaysRun: true}
+	teardown := client.ConfigCmd{ID: "teardown", Script: "false"}
+	teardown.Type.ID = "teardown"
+	adapter := &noopAdapter{}
+	adapter.FailCommandForTest(fail.ID)
+	adapter.FailCommandForTest(teardown.ID)
+	rep := newStatusReporter()
+	log := client.NewLog()
+	defer log.Close()
+	go log.Drain()
+	eng := Engine{reporter: rep,
+		clientLog: log,
+		adapter:   adapter,
+		config:    &client.Config{Cmds: []client.ConfigCmd{fail, skipped, cleanup, teardown}},
+	}
+
+	result, err := eng.executeCommands(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, RESULT_FAILED, result)
+	assert.Equal(t, map[string]int{"fail": 1, "cleanup": 0, "teardown": 1}, rep.retCodes)
+}
+
+func TestAlwaysRunDoesNotFailBuild(t *testing.T) {
+	cmd := client.ConfigCmd{ID: "cmd", Script: "true"}
+	teardown := client.ConfigCmd{ID: "teardown", Script: "false", AlwaysRun: true}
+	adapter := &noopAdapter{}
+	adapter.FailCommandForTest(teardown.ID)
+	rep := newStatusReporter()
+	log := client.NewLog()
+	defer log.Close()
+	go log.Drain()
+	eng := Engine{reporter: rep,
+		clientLog: log,
+		adapter:   adapter,
+		config:    &client.Config{Cmds: []client.ConfigCmd{cmd, teardown}},
+	}
+
+	result, err := eng.executeCommands(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, RESULT_PASSED, result)
+	assert.Equal(t, map[string]int{"cmd": 0, "teardown": 1}, rep.retCodes)
+}
+
+func TestAlwaysRunAfterTimeoutAndAbort(t *testing.T) {
+	hang := client.ConfigCmd{ID: "hang", Script: "sleep 1000"}
+	teardown := client.ConfigCmd{ID: "teardown", Script: "true", AlwaysRun: true}
+	adapter := &noopAdapter{}
+	adapter.HangCommandForTest(hang.ID)
+	newEngine := func(rep *statusReporter) *Engine {
+		log := client.NewLog()
+		go log.Drain()
+		return &Engine{reporter: rep,
+			clientLog: log,
+			adapter:   adapter,
+			config: &client.Config{
+				Cmds:    []client.ConfigCmd{hang, teardown},
+				Timeout: 1,
+			},
+		}
+	}
+
+	rep := newStatusReporter()
+	eng := newEngine(rep)
+	result, err := eng.executeCommands(context.Background())
+	eng.clientLog.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, RESULT_FAILED, result)
+	assert.Equal(t, map[string]int{"hang": RETURN_CODE_TIMED_OUT, "teardown": 0}, rep.retCodes)
+
+	rep = newStatusReporter()
+	eng = newEngine(rep)
+	var buf bytes.Buffer
+	eng.events = NewEventLog(nopWriteCloser{&buf}, "jobstep")
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	result, err = eng.executeCommands(ctx)
+	eng.clientLog.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, RESULT_ABORTED, result)
+	// The aborted command is still reported as finished, having been killed.
+	killed := 128 + int(syscall.SIGKILL)
+	assert.Equal(t, map[string]int{"hang": killed, "teardown": 0}, rep.retCodes)
+
+	var finished []string
+	dec := json.NewDecoder(&buf)
+	for {
+		var ev Event
+		if err := dec.Decode(&ev); err == io.EOF {
+			break
+		} else if !assert.NoError(t, err) {
+			return
+		}
+		if ev.Type == EVENT_COMMAND_FINISHED && assert.NotNil(t, ev.ExitCode) {
+			finished = append(finished, fmt.Sprintf("%s %d", ev.CommandID, *ev.ExitCode))
+		}
+	}
+	assert.Equal(t, []string{fmt.Sprintf("hang %d", killed), "teardown 0"}, finished)
+}
+
+func TestConditionalCommands(t *testing.T) {
+	f, err := ioutil.TempFile("", "condition")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	cmds := []client.ConfigCmd{
+		{ID: "pass", Script: "true"},
+		{ID: "diagnose", Script: "true", Condition: client.CommandCondition{PreviousFailed: true}},
+		{ID: "other-adapter", Script: "true", Condition: client.CommandCondition{Adapter: "not-" + selectedAdapterFlag}},
+		{ID: "env", Script: "true", Env: map[string]string{"FOO": "1"}, Condition: client.CommandCondition{EnvSet: "FOO"}},
+		{ID: "no-env", Script: "true", Condition: client.CommandCondition{EnvSet: "CHANGES_CLIENT_TEST_UNSET"}},
+		{ID: "file", Script: "true", Condition: client.CommandCondition{FileExists: f.Name()}},
+		{ID: "no-file", Script: "true", Condition: client.CommandCondition{FileExists: f.Name() + ".missing"}},
+	}
+	rep := newStatusReporter()
+	log := client.NewLog()
+	defer log.Close()
+	go log.Drain()
+	eng := Engine{reporter: rep,
+		clientLog: log,
+		adapter:   &noopAdapter{},
+		config:    &client.Config{Cmds: cmds},
+	}
+
+	result, err := eng.executeCommands(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, RESULT_PASSED, result)
+	assert.Equal(t, map[string]int{"pass": 0, "env": 0, "file": 0}, rep.retCodes)
+	assert.Equal(t, []string{"diagnose", "other-adapter", "no-env", "no-file"}, rep.skipped)
+}
+
+func TestPreviousFailedCommands(t *testing.T) {
+	cmds := []client.ConfigCmd{
+		{ID: "fail", Script: "false"},
+		{ID: "not-run", Script: "true"},
+		{ID: "diagnose", Script: "false", Condition: client.CommandCondition{PreviousFailed: true}},
+	}
+	adapter := &noopAdapter{}
+	adapter.FailCommandForTest("fail")
+	adapter.FailCommandForTest("diagnose")
+	rep := newStatusReporter()
+	log := client.NewLog()
+	defer log.Close()
+	go log.Drain()
+	eng := Engine{reporter: rep,
+		clientLog: log,
+		adapter:   adapter,
+		config:    &client.Config{Cmds: cmds},
+	}
+
+	result, err := eng.executeCommands(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, RESULT_FAILED, result)
+	assert.Equal(t, map[string]int{"fail": 1, "diagnose": 1}, rep.retCodes)
+	assert.Empty(t, rep.skipped)
+}
+
+func TestRetryFlakyCommand(t *testing.T) {
+	cmd := client.ConfigCmd{ID: "flaky", Script: "exit 3"}
+	cmd.Retry = client.RetryPolicy{MaxAttempts: 3, ExitCodes: []int{3}}
+	adapter := &noopAdapter{}
+	adapter.FailCommandTimesForTest(cmd.ID, 2)
+	rep := newStatusReporter()
+	log := client.NewLog()
+	defer log.Close()
+	go log.Drain()
+	eng := Engine{reporter: rep,
+		clientLog: log,
+		adapter:   adapter,
+		config:    &client.Config{Cmds: []client.ConfigCmd{cmd}},
+	}
+
+	result, err := eng.executeCommands(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, RESULT_FLAKY, result)
+	assert.Equal(t, 0, rep.retCodes[cmd.ID])
+	assert.Equal(t, 3, rep.attempts[cmd.ID])
+}
+
+func TestFlakyJobstepReportedAsPassed(t *testing.T) {
+	cmd := client.ConfigCmd{ID: "flaky", Script: "exit 3"}
+	cmd.Retry = client.RetryPolicy{MaxAttempts: 2}
+	adapter := &noopAdapter{}
+	adapter.FailCommandTimesForTest(cmd.ID, 1)
+	rep := newStatusReporter()
+	eng := Engine{reporter: rep,
+		clientLog: client.NewLog(),
+		adapter:   adapter,
+		config:    &client.Config{Cmds: []client.ConfigCmd{cmd}},
+	}
+
+	result, err := eng.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, RESULT_FLAKY, result)
+	assert.Equal(t, []string{STATUS_IN_PROGRESS + " ", STATUS_FINISHED + " passed"}, rep.jobstep)
+	assert.Equal(t, 1.0, rep.metrics["jobstepFlaky"])
+	assert.Equal(t, 2, rep.attempts[cmd.ID])
+}
+
+func TestRetryExhausted(t *testing.T) {
+	cmd := client.ConfigCmd{ID: "broken", Script: "exit 3"}
+	cmd.Retry = client.RetryPolicy{MaxAttempts: 2}
+	adapter := &noopAdapter{}
+	adapter.FailCommandTimesForTest(cmd.ID, 2)
+	rep := newStatusReporter()
+	log := client.NewLog()
+	defer log.Close()
+	go log.Drain()
+	eng := Engine{reporter: rep,
+		clientLog: log,
+		adapter:   adapter,
+		config:    &client.Config{Cmds: []client.ConfigCmd{cmd}},
+	}
+
+	result, err := eng.executeCommands(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, RESULT_FAILED, result)
+	assert.Equal(t, 2, rep.attempts[cmd.ID])
+	assert.Equal(t, 3, rep.retCodes[cmd.ID])
+}
+
+func TestRetryNonRetryableExitCode(t *testing.T) {
+	cmd := client.ConfigCmd{ID: "broken", Script: "exit 1"}
+	cmd.Retry = client.RetryPolicy{MaxAttempts: 3, ExitCodes: []int{3}}
+	adapter := &noopAdapter{}
+	adapter.FailCommandForTest(cmd.ID)
+	rep := newStatusReporter()
+	log := client.NewLog()
+	defer log.Close()
+	go log.Drain()
+	eng := Engine{reporter: rep,
+		clientLog: log,
+		adapter:   adapter,
+		config:    &client.Config{Cmds: []client.ConfigCmd{cmd}},
+	}
+
+	result, err := eng.executeCommands(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, RESULT_FAILED, result)
+	assert.Equal(t, 1, rep.attempts[cmd.ID])
+}
+
+func TestUnresolvableSecret(t *testing.T) {
+	cmd := client.ConfigCmd{ID: "deploy", Script: "true",
+		Env: map[string]string{"TOKEN": "secret://deploy-token"}}
+	rep := newStatusReporter()
+	log := client.NewLog()
+	defer log.Close()
+	go log.Drain()
+	eng := Engine{reporter: rep,
+		clientLog: log,
+		adapter:   &noopAdapter{},
+		config:    &client.Config{Cmds: []client.ConfigCmd{cmd}},
+	}
+
+	result, err := eng.executeCommands(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, RESULT_INFRA_FAILED, result)
+	assert.Equal(t, 255, rep.retCodes[cmd.ID])
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestCommandEvents(t *testing.T) {
+	pass := client.ConfigCmd{ID: "pass", Script: "true"}
+	fail := client.ConfigCmd{ID: "fail", Script: "false"}
+	adapter := &noopAdapter{}
+	adapter.FailCommandTimesForTest(fail.ID, 1)
+	var buf bytes.Buffer
+	log := client.NewLog()
+	defer log.Close()
+	go log.Drain()
+	eng := Engine{reporter: &reporter.NoopReporter{},
+		clientLog: log,
+		adapter:   adapter,
+		config:    &client.Config{Cmds: []client.ConfigCmd{pass, fail}},
+		events:    NewEventLog(nopWriteCloser{&buf}, "jobstep"),
+	}
+
+	result, err := eng.executeCommands(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, RESULT_FAILED, result)
+
+	var events []Event
+	dec := json.NewDecoder(&buf)
+	for {
+		var ev Event
+		if err := dec.Decode(&ev); err == io.EOF {
+			break
+		} else if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, "jobstep", ev.JobstepID)
+		events = append(events, ev)
+	}
+	var types []string
+	for _, ev := range events {
+		types = append(types, ev.Type+" "+ev.CommandID)
+	}
+	assert.Equal(t, []string{
+		"command_started pass", "command_finished pass", "artifacts_published pass",
+		"command_started fail", "command_finished fail", "artifacts_published fail",
+	}, types)
+	if assert.NotNil(t, events[1].ExitCode) {
+		assert.Equal(t, 0, *events[1].ExitCode)
+	}
+	if assert.NotNil(t, events[4].ExitCode) {
+		assert.Equal(t, 3, *events[4].ExitCode)
+	}
+	assert.Nil(t, events[0].ExitCode)
+}
+
+func TestDryRun(t *testing.T) {
+	config := &client.Config{JobstepID: "jobstep", Cmds: []client.ConfigCmd{
+		{ID: "setup", Script: "#!/bin/bash\necho setup\n", Env: map[string]string{"B": "secret", "A": "1"}},
+		{ID: "lint", Script: "make lint", Group: "checks"},
+		{ID: "unit", Script: "make test", Group: "checks", Timeout: 60},
+	}}
+	config.Cmds[2].Type.ID = "tset"
+	var buf bytes.Buffer
+	assert.NoError(t, DryRun(config, &buf))
+	out := buf.String()
+	assert.Contains(t, out, "Step 1:\n  Command setup\n    env: A, B\n    script:\n      #!/bin/bash\n      echo setup\n")
+	assert.Contains(t, out, "Step 2: 2 commands in parallel group checks\n")
+	assert.Contains(t, out, "    timeout: 1m0s\n")
+	assert.NotContains(t, out, "secret")
+	assert.Contains(t, out, "WARNING: commands[2].type.id: unknown type \"tset\"\n")
+
+	config.Cmds = append(config.Cmds, client.ConfigCmd{ID: "unit", Script: "true"})
+	buf.Reset()
+	assert.Error(t, DryRun(config, &buf))
+	assert.Empty(t, buf.String())
+}
+
+func TestSelectedReporter(t *testing.T) {
+	assert.Equal(t, selectedReporterFlag, selectedReporter(&client.Config{}))
+	assert.Equal(t, "local", selectedReporter(&client.Config{ConfigFile: "-"}))
+}
+
+func TestParallelCommands(t *testing.T) {
+	cmds := []client.ConfigCmd{
+		{ID: "lint", Group: "checks"},
+		{ID: "unit", Group: "checks"},
+		{ID: "integration", Group: "checks"},
+		{ID: "never"},
+	}
+	adapter := &noopAdapter{}
+	adapter.FailCommandForTest("unit")
+	rep := newStatusReporter()
+	log := client.NewLog()
+	defer log.Close()
+	go log.Drain()
+	eng := Engine{reporter: rep,
+		clientLog: log,
+		adapter:   adapter,
+		config:    &client.Config{Cmds: cmds},
+	}
+
+	result, err := eng.executeCommands(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, RESULT_FAILED, result)
+	assert.Equal(t, map[string]int{"lint": 0, "unit": 1, "integration": 0}, rep.retCodes)
+	assert.Equal(t, map[string]bool{"cmd-lint": true, "cmd-unit": true, "cmd-integration": true}, rep.logSources)
+}
+
+func TestCommandLogSource(t *testing.T) {
+	cmd := client.ConfigCmd{ID: "build", Script: "true"}
+	rep := newStatusReporter()
+	log := client.NewLog()
+	reported := make(chan struct{})
+	go func() {
+		reportLogChunks("console", log, rep)
+		close(reported)
+	}()
+	eng := Engine{reporter: rep,
+		clientLog: log,
+		adapter:   &noopAdapter{},
+		config:    &client.Config{Cmds: []client.ConfigCmd{cmd}},
+	}
+
+	result, err := eng.executeCommands(context.Background())
+	log.Close()
+	<-reported
+	assert.NoError(t, err)
+	assert.Equal(t, RESULT_PASSED, result)
+	// Sequential commands still log to the console as well.
+	assert.Contains(t, rep.logs["cmd-build"], "==> Running command build\n")
+	assert.Contains(t, rep.logs["console"], "==> Running command build\n")
+}
+
+func TestLocalReporterOutput(t *testing.T) {
+	defer func(v bool) { separateStderrFlag = v }(separateStderrFlag)
+	separateStderrFlag = true
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	stdout := os.Stdout
+	os.Stdout = w
+	rep := localreporter.New()
+	os.Stdout = stdout
+
+	config := &client.Config{ArtifactSearchPath: ".", Cmds: []client.ConfigCmd{
+		{ID: "seq", Script: "#!/bin/sh\necho seq-out\necho seq-err >&2\n"},
+		{ID: "p1", Script: "#!/bin/sh\necho p1-out\n", Group: "g"},
+		{ID: "p2", Script: "#!/bin/sh\necho p2-out\n", Group: "g"},
+	}}
+	rep.Init(config)
+	basic := basicadapter.New()
+	require.NoError(t, basic.Init(config))
+	log := client.NewLog()
+	reported := make(chan struct{})
+	go func() {
+		reportLogChunks("console", log, rep)
+		close(reported)
+	}()
+	eng := Engine{reporter: rep,
+		clientLog: log,
+		adapter:   basic,
+		config:    config,
+	}
+	result, err := eng.executeCommands(context.Background())
+	log.Close()
+	<-reported
+	w.Close()
+	require.NoError(t, err)
+	assert.Equal(t, RESULT_PASSED, result)
+
+	out, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	counts := make(map[string]int)
+	for _, line := range strings.Split(string(out), "\n") {
+		counts[line]++
+	}
+	for _, line := range []string{"seq-out", "seq-err", "p1-out", "p2-out", "==> Running command seq"} {
+		assert.Equal(t, 1, counts[line], line)
+	}
+}
+
 func makeResetFunc(s *string) func() {
 	previous := *s
 	return func() {
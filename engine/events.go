@@ -0,0 +1,111 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of events written to the event log.
+const (
+	EVENT_JOBSTEP_STARTED     = "jobstep_started"
+	EVENT_JOBSTEP_FINISHED    = "jobstep_finished"
+	EVENT_ADAPTER_PREPARED    = "adapter_prepared"
+	EVENT_ADAPTER_SHUTDOWN    = "adapter_shutdown"
+	EVENT_COMMAND_STARTED     = "command_started"
+	EVENT_COMMAND_FINISHED    = "command_finished"
+	EVENT_COMMAND_SKIPPED     = "command_skipped"
+	EVENT_ARTIFACTS_PUBLISHED = "artifacts_published"
+	EVENT_SNAPSHOT_CAPTURED   = "snapshot_captured"
+)
+
+// Event is a single entry in the event log. Fields that don't apply to an
+// event type are omitted.
+type Event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	JobstepID string    `json:"jobstepId"`
+	CommandID string    `json:"commandId,omitempty"`
+	Attempt   int       `json:"attempt,omitempty"`
+	// Nil unless the event is for a finished command.
+	ExitCode *int `json:"exitCode,omitempty"`
+	// In seconds.
+	Duration   float64 `json:"duration,omitempty"`
+	Result     string  `json:"result,omitempty"`
+	SnapshotID string  `json:"snapshotId,omitempty"`
+	// Why a command was skipped.
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// EventLog writes the lifecycle of a JobStep as newline-delimited JSON, for
+// consumption by tools that would otherwise have to scrape the logs.
+// All methods are safe to call on a nil *EventLog, which discards events.
+type EventLog struct {
+	jobstepID string
+	mu        sync.Mutex
+	w         io.WriteCloser
+	enc       *json.Encoder
+	failed    bool
+}
+
+func NewEventLog(w io.WriteCloser, jobstepID string) *EventLog {
+	return &EventLog{jobstepID: jobstepID, w: w, enc: json.NewEncoder(w)}
+}
+
+// OpenEventLog opens the event log destination given by dest, which is either
+// a path to append to, or "fd:N" for an already open file descriptor.
+func OpenEventLog(dest string, jobstepID string) (*EventLog, error) {
+	if strings.HasPrefix(dest, "fd:") {
+		fd, err := strconv.Atoi(strings.TrimPrefix(dest, "fd:"))
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("Invalid event log file descriptor: %q", dest)
+		}
+		return NewEventLog(os.NewFile(uintptr(fd), dest), jobstepID), nil
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewEventLog(f, jobstepID), nil
+}
+
+// Write records ev, filling in its time and JobStep.
+func (el *EventLog) Write(ev Event) {
+	if el == nil {
+		return
+	}
+	ev.Time = time.Now().UTC()
+	ev.JobstepID = el.jobstepID
+
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	if err := el.enc.Encode(ev); err != nil && !el.failed {
+		// Only complain once; the build is more important than its events.
+		el.failed = true
+		log.Printf("[engine] Failed to write to event log: %s", err)
+	}
+}
+
+func (el *EventLog) Close() error {
+	if el == nil {
+		return nil
+	}
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	return el.w.Close()
+}
+
+// Returns the message of err, or an empty string if it is nil.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
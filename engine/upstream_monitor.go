@@ -4,10 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/dropbox/changes-client/client"
-	"hash/fnv"
+	"github.com/dropbox/changes-client/common/auth"
+	"github.com/dropbox/changes-client/common/retry"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"net/http"
 	"time"
 )
@@ -31,19 +31,29 @@ type HeartbeatResponse struct {
 }
 
 func (um *UpstreamMonitor) WaitUntilAbort() error {
-	client := &http.Client{}
+	client, err := auth.NewClient(um.Config.JobstepID)
+	if err != nil {
+		// Returning would abort the build, so carry on without credentials.
+		log.Printf("[upstream] Failed to set up authentication: %s", err)
+		client = &http.Client{}
+	}
 
-	h := fnv.New64()
 	// seed with JobstepID so each jobstep hits Changes at slightly
 	// different times
-	h.Write([]byte(um.Config.JobstepID))
-	// make our own random generator so that heartbeat variance is
-	// unaffected by other interspersed calls to math/rand
-	randGen := rand.New(rand.NewSource(int64(h.Sum64())))
+	randGen := retry.NewRand(um.Config.JobstepID)
+	policy := retry.DefaultPolicy()
+	// Don't let retries delay the next heartbeat much.
+	policy.MaxElapsed = 20 * time.Second
+	retrier := retry.New(policy, um.Config.JobstepID)
 	for {
 		log.Printf("[upstream] sending heartbeat")
 
-		hr, err := um.postHeartbeat(client)
+		var hr *HeartbeatResponse
+		err := retrier.Do("Sending heartbeat", func(attempt int) error {
+			var err error
+			hr, err = um.postHeartbeat(client)
+			return err
+		})
 		if err != nil {
 			log.Printf("[upstream] %s", err)
 		} else if hr.Finished {
@@ -84,7 +94,8 @@ func (um *UpstreamMonitor) postHeartbeat(client *http.Client) (*HeartbeatRespons
 	}
 
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Request to fetch JobStep failed with status code: %d", resp.StatusCode)
+		return nil, &retry.StatusError{Code: resp.StatusCode,
+			Message: fmt.Sprintf("Request to fetch JobStep failed with status code: %d", resp.StatusCode)}
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
@@ -43,6 +43,8 @@ type Reporter struct {
 	deadline         time.Duration
 	// If unset, falls back to artifactServer.
 	serverURL string
+	// Guards chunkedArtifacts, as logs for several sources may be pushed at once.
+	chunkedArtifactsMux sync.Mutex
 }
 
 func (r *Reporter) markDeadlineExceeded() {
@@ -91,7 +93,7 @@ func (r *Reporter) PushJobstepStatus(status string, result string) {
 	// IGNORED - Not relevant
 }
 
-func (r *Reporter) PushCommandStatus(cID string, status string, retCode int) {
+func (r *Reporter) PushCommandStatus(cID string, status string, retCode int, attempt int, result *client.CommandResult) {
 	// IGNORED - Not relevant
 }
 
@@ -114,6 +116,8 @@ func (r *Reporter) PushLogChunk(source string, payload []byte) bool {
 			return
 		}
 
+		r.chunkedArtifactsMux.Lock()
+		defer r.chunkedArtifactsMux.Unlock()
 		if _, ok := r.chunkedArtifacts[source]; !ok {
 			if artifact, err := r.bucket.NewChunkedArtifact(source); err != nil {
 				sentry.Error(err, map[string]string{})
@@ -138,7 +142,7 @@ func (r *Reporter) PushLogChunk(source string, payload []byte) bool {
 	}
 }
 
-func (r *Reporter) PushCommandOutput(cID string, status string, retCode int, output []byte) {
+func (r *Reporter) PushCommandOutput(cID string, status string, retCode int, attempt int, result *client.CommandResult, output []byte) {
 	// IGNORED - We don't support command level outputs yet.
 	// TODO: At some point in the future, we can add a per-command artifact to track output of each different command.
 }
@@ -260,6 +264,8 @@ func (r *Reporter) shutdown() {
 
 	// Wait for queued uploads to complete.
 	log.Printf("[artifactstore] Waiting for artifacts to upload...")
+	r.chunkedArtifactsMux.Lock()
+	defer r.chunkedArtifactsMux.Unlock()
 	for _, cArt := range r.chunkedArtifacts {
 		if err := cArt.Flush(); err != nil {
 			sentry.Error(err, map[string]string{})
@@ -30,14 +30,14 @@ func (r *Reporter) Init(c *client.Config) {
 func (r *Reporter) PushJobstepStatus(status string, result string) {
 }
 
-func (r *Reporter) PushCommandStatus(cID string, status string, retCode int) {
+func (r *Reporter) PushCommandStatus(cID string, status string, retCode int, attempt int, result *client.CommandResult) {
 }
 
 func (r *Reporter) PushLogChunk(source string, payload []byte) bool {
 	return true
 }
 
-func (r *Reporter) PushCommandOutput(cID string, status string, retCode int, output []byte) {
+func (r *Reporter) PushCommandOutput(cID string, status string, retCode int, attempt int, result *client.CommandResult, output []byte) {
 }
 
 // If we were running in an lxc container, the artifacts are already grouped
@@ -0,0 +1,106 @@
+package localreporter
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/dropbox/changes-client/client"
+	"github.com/dropbox/changes-client/client/adapter"
+	"github.com/dropbox/changes-client/client/reporter"
+)
+
+// A reporter for builds run without a Changes server, such as when a
+// developer reproduces a JobStep from a config file on their own machine.
+// Logs are written to stdout, and statuses and artifacts are only logged.
+type Reporter struct {
+	// Guards writes to out, as parallel commands report concurrently.
+	mu  sync.Mutex
+	out io.Writer
+	// The log sources of commands in parallel groups, whose output doesn't
+	// also go to the console.
+	parallelSources map[string]bool
+}
+
+func (r *Reporter) Init(c *client.Config) {
+	log.Printf("[reporter] Reporting locally for config %s", c.ConfigFile)
+	r.parallelSources = make(map[string]bool)
+	for _, group := range client.GroupCommands(c.Cmds) {
+		if len(group) == 1 {
+			continue
+		}
+		for _, cmd := range group {
+			r.parallelSources["cmd-"+cmd.ID] = true
+		}
+	}
+}
+
+func (r *Reporter) PushJobstepStatus(status string, result string) {
+	log.Printf("[reporter] Jobstep status: %s %s", status, result)
+}
+
+func (r *Reporter) PushCommandStatus(cID string, status string, retCode int, attempt int, result *client.CommandResult) {
+	if result == nil {
+		log.Printf("[reporter] Command %s status: %s (return code %d, attempt %d)", cID, status, retCode, attempt)
+		return
+	}
+	log.Printf("[reporter] Command %s status: %s (return code %d, attempt %d, wall time %s, CPU time %s)",
+		cID, status, retCode, attempt, result.WallTime, result.CPUTime)
+}
+
+func (r *Reporter) PushCommandOutput(cID string, status string, retCode int, attempt int, result *client.CommandResult, output []byte) {
+	r.PushCommandStatus(cID, status, retCode, attempt, result)
+}
+
+func (r *Reporter) PushLogChunk(source string, payload []byte) bool {
+	// The infra log already goes to stderr, and other command sources,
+	// including separate stderr, repeat what is in the console.
+	if source != "console" && !r.parallelSources[source] {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.out.Write(payload); err != nil {
+		log.Printf("[reporter] Failed to write %s log chunk: %s", source, err)
+		return false
+	}
+	return true
+}
+
+func (r *Reporter) PushSnapshotImageStatus(iID string, status string) error {
+	log.Printf("[reporter] Snapshot %s status: %s", iID, status)
+	return nil
+}
+
+func (r *Reporter) ReportMetrics(metrics client.Metrics) {
+	for k, v := range metrics {
+		log.Printf("[reporter] Metric %s: %v", k, v)
+	}
+}
+
+// Artifacts are left where the commands wrote them; we just say where that is.
+func (r *Reporter) PublishArtifacts(cmd client.ConfigCmd, a adapter.Adapter, clientLog *client.Log) error {
+	if len(cmd.Artifacts) == 0 {
+		return nil
+	}
+	matches, err := a.CollectArtifacts(cmd.Artifacts, clientLog)
+	if err != nil {
+		clientLog.Printf("[reporter] ERROR filtering artifacts: %s", err)
+		return err
+	}
+	for _, m := range matches {
+		clientLog.Printf("==> Found artifact: %s", m)
+	}
+	return nil
+}
+
+func (r *Reporter) Shutdown() {}
+
+func New() reporter.Reporter {
+	return &Reporter{out: os.Stdout}
+}
+
+func init() {
+	reporter.Register("local", New)
+}
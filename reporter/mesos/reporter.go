@@ -5,6 +5,7 @@ import (
 	"log"
 	"os/exec"
 	"strconv"
+	"time"
 
 	"github.com/dropbox/changes-client/client"
 	"github.com/dropbox/changes-client/client/adapter"
@@ -41,15 +42,29 @@ func (r *Reporter) PushJobstepStatus(status string, result string) {
 	r.PublishChannel <- reporter.ReportPayload{Path: r.JobstepAPIPath(), Data: form, Filename: ""}
 }
 
-func (r *Reporter) PushCommandStatus(cID string, status string, retCode int) {
+func (r *Reporter) PushCommandStatus(cID string, status string, retCode int, attempt int, result *client.CommandResult) {
 	form := make(map[string]string)
 	form["status"] = status
 	if retCode >= 0 {
 		form["return_code"] = strconv.Itoa(retCode)
 	}
+	form["attempt"] = strconv.Itoa(attempt)
+	addResultFields(form, result)
 	r.PublishChannel <- reporter.ReportPayload{Path: "/commands/" + cID + "/", Data: form, Filename: ""}
 }
 
+// Adds the details of how a command's process finished to form.
+func addResultFields(form map[string]string, result *client.CommandResult) {
+	if result == nil {
+		return
+	}
+	if result.Signal != 0 {
+		form["signal"] = strconv.Itoa(int(result.Signal))
+	}
+	form["wall_time_ms"] = strconv.FormatInt(int64(result.WallTime/time.Millisecond), 10)
+	form["cpu_time_ms"] = strconv.FormatInt(int64(result.CPUTime/time.Millisecond), 10)
+}
+
 func (r *Reporter) PushLogChunk(source string, payload []byte) bool {
 	if r.dontPushLogChunks {
 		return true
@@ -65,13 +80,15 @@ func (r *Reporter) PushLogChunk(source string, payload []byte) bool {
 	return true
 }
 
-func (r *Reporter) PushCommandOutput(cID string, status string, retCode int, output []byte) {
+func (r *Reporter) PushCommandOutput(cID string, status string, retCode int, attempt int, result *client.CommandResult, output []byte) {
 	form := make(map[string]string)
 	form["status"] = status
 	form["output"] = string(output)
 	if retCode >= 0 {
 		form["return_code"] = strconv.Itoa(retCode)
 	}
+	form["attempt"] = strconv.Itoa(attempt)
+	addResultFields(form, result)
 	r.PublishChannel <- reporter.ReportPayload{Path: "/commands/" + cID + "/", Data: form, Filename: ""}
 }
 
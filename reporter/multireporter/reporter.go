@@ -50,9 +50,9 @@ func (r *Reporter) PushJobstepStatus(status string, result string) {
 	}
 }
 
-func (r *Reporter) PushCommandStatus(cID string, status string, retCode int) {
+func (r *Reporter) PushCommandStatus(cID string, status string, retCode int, attempt int, result *client.CommandResult) {
 	for _, r := range r.reporterDestinations {
-		r.PushCommandStatus(cID, status, retCode)
+		r.PushCommandStatus(cID, status, retCode, attempt, result)
 	}
 }
 
@@ -74,9 +74,9 @@ func (r *Reporter) PushLogChunk(source string, payload []byte) bool {
 	return success
 }
 
-func (r *Reporter) PushCommandOutput(cID string, status string, retCode int, output []byte) {
+func (r *Reporter) PushCommandOutput(cID string, status string, retCode int, attempt int, result *client.CommandResult, output []byte) {
 	for _, r := range r.reporterDestinations {
-		r.PushCommandOutput(cID, status, retCode, output)
+		r.PushCommandOutput(cID, status, retCode, attempt, result, output)
 	}
 }
 